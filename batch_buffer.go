@@ -0,0 +1,139 @@
+package godatabend
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultBatchBufferSize int64 = 8 * 1024 * 1024
+	batchSpillWriterSize         = 1024 * 1024
+)
+
+// batchBuffer accumulates the encoded rows of a batch in memory, once the
+// buffered data exceeds the threshold it is spilled to a temporary file and all
+// the following writes go through a buffered file writer.
+type batchBuffer struct {
+	threshold int64
+	dir       string
+	size      int64
+
+	mem  bytes.Buffer
+	file *os.File
+	w    *bufio.Writer
+	// keep the file on Close, used by the spooled batches
+	keep bool
+}
+
+func newBatchBuffer(threshold int64, dir string) *batchBuffer {
+	if threshold <= 0 {
+		threshold = defaultBatchBufferSize
+	}
+	return &batchBuffer{
+		threshold: threshold,
+		dir:       dir,
+	}
+}
+
+// newSpoolBatchBuffer writes the data straight into the file of the given path, the
+// file is kept on Close.
+func newSpoolBatchBuffer(path string) (*batchBuffer, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "create batch spool file failed")
+	}
+	return &batchBuffer{
+		file: f,
+		w:    bufio.NewWriterSize(f, batchSpillWriterSize),
+		keep: true,
+	}, nil
+}
+
+func (b *batchBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && int64(b.mem.Len()+len(p)) > b.threshold {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	var (
+		n   int
+		err error
+	)
+	if b.file != nil {
+		n, err = b.w.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+func (b *batchBuffer) spill() error {
+	f, err := os.CreateTemp(b.dir, "databend-batch-*")
+	if err != nil {
+		return errors.Wrap(err, "create batch spill file failed")
+	}
+	b.file = f
+	b.w = bufio.NewWriterSize(f, batchSpillWriterSize)
+	if _, err = b.w.Write(b.mem.Bytes()); err != nil {
+		return errors.Wrap(err, "write batch spill file failed")
+	}
+	b.mem = bytes.Buffer{}
+	return nil
+}
+
+// Size returns the number of bytes written into the buffer.
+func (b *batchBuffer) Size() int64 {
+	return b.size
+}
+
+// Spilled reports whether the buffer has been spilled to disk.
+func (b *batchBuffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Sync flushes the buffered data to the disk if the buffer is backed by a file.
+func (b *batchBuffer) Sync() error {
+	if b.file == nil {
+		return nil
+	}
+	if err := b.w.Flush(); err != nil {
+		return errors.Wrap(err, "flush batch file failed")
+	}
+	return b.file.Sync()
+}
+
+// Reader returns a reader over all the buffered data from the beginning, the
+// buffer should not be written while the reader is in use.
+func (b *batchBuffer) Reader() (io.Reader, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.mem.Bytes()), nil
+	}
+	if err := b.w.Flush(); err != nil {
+		return nil, errors.Wrap(err, "flush batch spill file failed")
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "seek batch spill file failed")
+	}
+	return io.LimitReader(b.file, b.size), nil
+}
+
+// Close releases the memory and removes the spill file if any.
+func (b *batchBuffer) Close() error {
+	b.mem = bytes.Buffer{}
+	if b.file == nil {
+		return nil
+	}
+	name := b.file.Name()
+	err := b.file.Close()
+	b.file = nil
+	b.w = nil
+	if b.keep {
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,612 @@
+package godatabend
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BatchFormat is the file format of the stage files uploaded by batch inserts.
+type BatchFormat string
+
+const (
+	BatchFormatCSV     BatchFormat = "csv"
+	BatchFormatNDJSON  BatchFormat = "ndjson"
+	BatchFormatParquet BatchFormat = "parquet"
+)
+
+// ContextKeyBatchFormat selects the BatchFormat of the batch insert prepared with the
+// context, it overrides the one in Config.
+const ContextKeyBatchFormat ContextKey = "BATCH-FORMAT"
+
+func parseBatchFormat(s string) (BatchFormat, error) {
+	switch BatchFormat(strings.ToLower(s)) {
+	case "", BatchFormatCSV:
+		return BatchFormatCSV, nil
+	case BatchFormatNDJSON:
+		return BatchFormatNDJSON, nil
+	case BatchFormatParquet:
+		return BatchFormatParquet, nil
+	}
+	return "", errors.Errorf("unsupported batch format %q", s)
+}
+
+func batchFormatFromContext(ctx context.Context, cfg *Config) (BatchFormat, error) {
+	switch v := ctx.Value(ContextKeyBatchFormat).(type) {
+	case BatchFormat:
+		return parseBatchFormat(string(v))
+	case string:
+		return parseBatchFormat(v)
+	}
+	return parseBatchFormat(string(cfg.BatchFormat))
+}
+
+func (c *APIClient) batchFormatOptions(format BatchFormat) map[string]string {
+	switch format {
+	case BatchFormatNDJSON:
+		return map[string]string{"type": "NDJSON"}
+	case BatchFormatParquet:
+		return map[string]string{"type": "PARQUET"}
+	default:
+		return c.NewDefaultCSVFormatOptions()
+	}
+}
+
+// batchColumn is a column of the table a batch inserts into.
+type batchColumn struct {
+	name     string
+	typ      string
+	nullable bool
+}
+
+// baseType returns the upper cased type name without the arguments, like DECIMAL for
+// DECIMAL(10, 2).
+func (c batchColumn) baseType() string {
+	typ := strings.ToUpper(strings.TrimSpace(c.typ))
+	if i := strings.Index(typ, "("); i >= 0 {
+		typ = strings.TrimSpace(typ[:i])
+	}
+	return typ
+}
+
+func (c batchColumn) isNested() bool {
+	switch c.baseType() {
+	case "ARRAY", "MAP", "TUPLE", "VARIANT":
+		return true
+	}
+	return false
+}
+
+// describeBatchColumns returns the columns of the table in the order of the column list
+// of the insert statement, or all the columns if there is no column list.
+func (dc *DatabendConn) describeBatchColumns(ctx context.Context, table, columnList string) ([]batchColumn, error) {
+	resp, err := dc.rest.QuerySync(ctx, fmt.Sprintf("DESC %s", table), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to describe table")
+	}
+	var columns []batchColumn
+	for _, row := range resp.Data {
+		if len(row) < 3 || row[0] == nil || row[1] == nil || row[2] == nil {
+			return nil, errors.Errorf("describe table invalid response: %+v", resp.Data)
+		}
+		columns = append(columns, batchColumn{
+			name:     *row[0],
+			typ:      *row[1],
+			nullable: strings.EqualFold(*row[2], "YES"),
+		})
+	}
+
+	columnList = strings.Trim(strings.TrimSpace(columnList), "()")
+	if columnList == "" {
+		return columns, nil
+	}
+	var selected []batchColumn
+	for _, name := range strings.Split(columnList, ",") {
+		name = strings.Trim(strings.TrimSpace(name), "`\"")
+		found := false
+		for _, col := range columns {
+			if strings.EqualFold(col.name, name) {
+				selected = append(selected, col)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("column %s not found in table %s", name, table)
+		}
+	}
+	return selected, nil
+}
+
+// batchEncoder encodes the rows of a batch into one stage file.
+type batchEncoder interface {
+	Encode(v []driver.Value) error
+	// Buffered returns the bytes encoded but not yet written out.
+	Buffered() int64
+	// Close writes out all the pending data, the encoder can't be used afterwards.
+	Close() error
+}
+
+func newBatchEncoder(format BatchFormat, w io.Writer, columns []batchColumn) (batchEncoder, error) {
+	switch format {
+	case BatchFormatNDJSON:
+		return &ndjsonBatchEncoder{w: w, columns: columns}, nil
+	case BatchFormatParquet:
+		parquetColumns := make([]*parquetColumn, len(columns))
+		for i, col := range columns {
+			c, err := newParquetColumn(col)
+			if err != nil {
+				return nil, err
+			}
+			parquetColumns[i] = c
+		}
+		return &parquetBatchEncoder{w: newParquetWriter(w, parquetColumns)}, nil
+	default:
+		return &csvBatchEncoder{w: csv.NewWriter(w)}, nil
+	}
+}
+
+type csvBatchEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvBatchEncoder) Encode(v []driver.Value) error {
+	lineData := make([]string, 0, len(v))
+	for i := range v {
+		lineData = append(lineData, fmt.Sprintf("%v", v[i]))
+	}
+	return e.w.Write(lineData)
+}
+
+func (e *csvBatchEncoder) Buffered() int64 {
+	return 0
+}
+
+func (e *csvBatchEncoder) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonBatchEncoder struct {
+	w       io.Writer
+	columns []batchColumn
+	line    bytes.Buffer
+}
+
+func (e *ndjsonBatchEncoder) Encode(v []driver.Value) error {
+	if len(v) != len(e.columns) {
+		return errors.Errorf("expect %d values, got %d", len(e.columns), len(v))
+	}
+	e.line.Reset()
+	e.line.WriteByte('{')
+	for i, col := range e.columns {
+		if i > 0 {
+			e.line.WriteByte(',')
+		}
+		name, _ := json.Marshal(col.name)
+		e.line.Write(name)
+		e.line.WriteByte(':')
+		value, err := ndjsonValue(col, v[i])
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode column %s", col.name)
+		}
+		e.line.Write(value)
+	}
+	e.line.WriteString("}\n")
+	_, err := e.w.Write(e.line.Bytes())
+	return err
+}
+
+func (e *ndjsonBatchEncoder) Buffered() int64 {
+	return 0
+}
+
+func (e *ndjsonBatchEncoder) Close() error {
+	return nil
+}
+
+// ndjsonValue keeps the values of nested and variant columns as they are if they are
+// valid json already, so they are not loaded as strings.
+func ndjsonValue(col batchColumn, v driver.Value) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return []byte("null"), nil
+	case string:
+		if col.isNested() && json.Valid([]byte(val)) {
+			return []byte(val), nil
+		}
+		return json.Marshal(val)
+	case []byte:
+		if col.isNested() && json.Valid(val) {
+			return val, nil
+		}
+		return json.Marshal(string(val))
+	case time.Time:
+		if col.baseType() == "DATE" {
+			return json.Marshal(val.Format(dateFormat))
+		}
+		return json.Marshal(val.Format(dateTime64Format))
+	}
+	return json.Marshal(v)
+}
+
+type parquetBatchEncoder struct {
+	w   *parquetWriter
+	row []interface{}
+}
+
+func (e *parquetBatchEncoder) Encode(v []driver.Value) error {
+	if len(v) != len(e.w.columns) {
+		return errors.Errorf("expect %d values, got %d", len(e.w.columns), len(v))
+	}
+	e.row = e.row[:0]
+	for i, col := range e.w.columns {
+		value, err := parquetValue(col, v[i])
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode column %s", col.name)
+		}
+		e.row = append(e.row, value)
+	}
+	return e.w.WriteRow(e.row)
+}
+
+func (e *parquetBatchEncoder) Buffered() int64 {
+	return e.w.Buffered()
+}
+
+func (e *parquetBatchEncoder) Close() error {
+	return e.w.Close()
+}
+
+// newParquetColumn maps the column type to a parquet type. VARIANT is written as JSON
+// and the other types without a parquet representation, like the temporal types with a
+// time zone, as strings which are casted on loading. The nested ARRAY, MAP and TUPLE
+// values would need repeated and group columns, which the writer doesn't support.
+func newParquetColumn(col batchColumn) (*parquetColumn, error) {
+	c := &parquetColumn{
+		name:      col.name,
+		converted: parquetConvertedNone,
+		nullable:  col.nullable,
+	}
+	switch col.baseType() {
+	case "ARRAY", "MAP", "TUPLE":
+		return nil, errors.Errorf("column %s of type %s is not supported by the parquet batch format, use ndjson instead", col.name, col.typ)
+	case "VARIANT":
+		c.typ, c.converted = parquetByteArray, parquetJSON
+		return c, nil
+	case "DECIMAL":
+		if err := c.setDecimal(col.typ); err != nil {
+			return nil, errors.Wrapf(err, "column %s", col.name)
+		}
+		return c, nil
+	}
+	switch strings.ToUpper(strings.TrimSpace(col.typ)) {
+	case "BOOLEAN":
+		c.typ = parquetBoolean
+	case "TINYINT":
+		c.typ, c.converted = parquetInt32, parquetInt8
+	case "SMALLINT":
+		c.typ, c.converted = parquetInt32, parquetInt16
+	case "INT":
+		c.typ = parquetInt32
+	case "BIGINT":
+		c.typ = parquetInt64
+	case "TINYINT UNSIGNED":
+		c.typ, c.converted = parquetInt32, parquetUint8
+	case "SMALLINT UNSIGNED":
+		c.typ, c.converted = parquetInt32, parquetUint16
+	case "INT UNSIGNED":
+		c.typ, c.converted = parquetInt32, parquetUint32
+	case "BIGINT UNSIGNED":
+		c.typ, c.converted = parquetInt64, parquetUint64
+	case "FLOAT":
+		c.typ = parquetFloat
+	case "DOUBLE":
+		c.typ = parquetDouble
+	case "DATE":
+		c.typ, c.converted = parquetInt32, parquetDate
+	case "TIMESTAMP":
+		c.typ, c.converted = parquetInt64, parquetTimestampMicros
+	case "BINARY":
+		c.typ = parquetByteArray
+	default:
+		c.typ, c.converted = parquetByteArray, parquetUTF8
+	}
+	return c, nil
+}
+
+// setDecimal sets the precision and scale of a DECIMAL(P, S) column, the unscaled values
+// are stored in the smallest physical type holding P digits.
+func (c *parquetColumn) setDecimal(typ string) error {
+	var args []string
+	if i := strings.Index(typ, "("); i >= 0 && strings.HasSuffix(typ, ")") {
+		args = strings.Split(typ[i+1:len(typ)-1], ",")
+	}
+	if len(args) != 2 {
+		return errors.Errorf("invalid decimal type %s", typ)
+	}
+	precision, err := strconv.Atoi(strings.TrimSpace(args[0]))
+	if err != nil {
+		return errors.Wrapf(err, "invalid decimal type %s", typ)
+	}
+	scale, err := strconv.Atoi(strings.TrimSpace(args[1]))
+	if err != nil {
+		return errors.Wrapf(err, "invalid decimal type %s", typ)
+	}
+	if precision <= 0 || scale < 0 || scale > precision {
+		return errors.Errorf("invalid decimal type %s", typ)
+	}
+	c.converted, c.precision, c.scale = parquetDecimal, int32(precision), int32(scale)
+	switch {
+	case precision <= 9:
+		c.typ = parquetInt32
+	case precision <= 18:
+		c.typ = parquetInt64
+	default:
+		c.typ = parquetByteArray
+	}
+	return nil
+}
+
+func isUnsignedParquetColumn(c *parquetColumn) bool {
+	switch c.converted {
+	case parquetUint8, parquetUint16, parquetUint32, parquetUint64:
+		return true
+	}
+	return false
+}
+
+// parquetValue converts the driver value to the go type of the parquet column, the
+// strings are parsed, so the rows appended for the CSV format work as well.
+func parquetValue(c *parquetColumn, v driver.Value) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch c.converted {
+	case parquetDecimal:
+		return parquetDecimalValue(c, v)
+	case parquetJSON:
+		// the valid json values are kept as they are, like in the ndjson format
+		return ndjsonValue(batchColumn{name: c.name, typ: "VARIANT"}, v)
+	}
+	if b, ok := v.([]byte); ok && c.typ != parquetByteArray {
+		v = string(b)
+	}
+	switch c.typ {
+	case parquetBoolean:
+		switch val := v.(type) {
+		case bool:
+			return val, nil
+		case int64:
+			return val != 0, nil
+		case string:
+			return strconv.ParseBool(val)
+		}
+	case parquetInt32, parquetInt64:
+		n, err := parquetInt(c, v)
+		if err != nil {
+			return nil, err
+		}
+		// the unsigned values are kept as the bits of the signed physical type
+		if c.typ == parquetInt32 {
+			return int32(n), nil
+		}
+		return n, nil
+	case parquetFloat, parquetDouble:
+		var f float64
+		switch val := v.(type) {
+		case float64:
+			f = val
+		case int64:
+			f = float64(val)
+		case string:
+			var err error
+			if f, err = strconv.ParseFloat(val, 64); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.Errorf("unsupported value %v of type %T", v, v)
+		}
+		if c.typ == parquetFloat {
+			return float32(f), nil
+		}
+		return f, nil
+	case parquetByteArray:
+		switch val := v.(type) {
+		case []byte:
+			return val, nil
+		case string:
+			return []byte(val), nil
+		case time.Time:
+			return []byte(val.Format(dateTime64Format)), nil
+		default:
+			return []byte(fmt.Sprintf("%v", val)), nil
+		}
+	}
+	return nil, errors.Errorf("unsupported value %v of type %T", v, v)
+}
+
+// parquetDecimalValue returns the unscaled value of a decimal, as the go type of the
+// physical type of the column, the floats are rounded to the scale of the column.
+func parquetDecimalValue(c *parquetColumn, v driver.Value) (interface{}, error) {
+	var s string
+	switch val := v.(type) {
+	case string:
+		s = strings.TrimSpace(val)
+	case []byte:
+		s = strings.TrimSpace(string(val))
+	case int64:
+		s = strconv.FormatInt(val, 10)
+	case uint64:
+		s = strconv.FormatUint(val, 10)
+	case float64:
+		s = strconv.FormatFloat(val, 'f', int(c.scale), 64)
+	default:
+		return nil, errors.Errorf("unsupported value %v of type %T", v, v)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || strings.Contains(s, "/") {
+		return nil, errors.Errorf("invalid decimal %q", s)
+	}
+	r.Mul(r, new(big.Rat).SetInt(pow10(c.scale)))
+	if !r.IsInt() {
+		return nil, errors.Errorf("decimal %s has more than %d digits after the point", s, c.scale)
+	}
+	n := r.Num()
+	if n.CmpAbs(pow10(c.precision)) >= 0 {
+		return nil, errors.Errorf("decimal %s is out of the range of DECIMAL(%d, %d)", s, c.precision, c.scale)
+	}
+	switch c.typ {
+	case parquetInt32:
+		return int32(n.Int64()), nil
+	case parquetInt64:
+		return n.Int64(), nil
+	}
+	return decimalBytes(n), nil
+}
+
+func pow10(n int32) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// decimalBytes encodes the unscaled value as a big-endian two's complement integer.
+func decimalBytes(n *big.Int) []byte {
+	size := n.BitLen()/8 + 1
+	if n.Sign() < 0 {
+		n = new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), uint(size*8)), n)
+	}
+	data := make([]byte, size)
+	n.FillBytes(data)
+	return data
+}
+
+var parquetTimeLayouts = []string{dateTime64Format, time.RFC3339Nano, dateFormat}
+
+func parquetInt(c *parquetColumn, v driver.Value) (int64, error) {
+	switch c.converted {
+	case parquetDate:
+		t, err := parquetTime(v)
+		if err != nil {
+			return 0, err
+		}
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400, nil
+	case parquetTimestampMicros:
+		t, err := parquetTime(v)
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano() / 1000, nil
+	}
+	var (
+		n int64
+		// u is set instead of n for the values above math.MaxInt64
+		u      uint64
+		isUint bool
+		err    error
+	)
+	switch val := v.(type) {
+	case int64:
+		n = val
+	case uint64:
+		u, isUint = val, true
+	case float64:
+		if val != math.Trunc(val) {
+			return 0, errors.Errorf("value %v is not an integer", val)
+		}
+		if val < math.MinInt64 || val >= math.MaxUint64 {
+			return 0, errors.Errorf("value %v is out of the range of 64-bit integers", val)
+		}
+		if val >= math.MaxInt64 {
+			u, isUint = uint64(val), true
+		} else {
+			n = int64(val)
+		}
+	case bool:
+		if val {
+			n = 1
+		}
+	case string:
+		if strings.HasPrefix(val, "-") {
+			n, err = strconv.ParseInt(val, 10, 64)
+		} else {
+			u, err = strconv.ParseUint(val, 10, 64)
+			isUint = true
+		}
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, errors.Errorf("unsupported value %v of type %T", v, v)
+	}
+	return checkParquetInt(c, v, n, u, isUint)
+}
+
+// checkParquetInt checks the integer, given as n or as u if isUint is set, fits in the
+// integer column, and returns it as the bits of an int64.
+func checkParquetInt(c *parquetColumn, v driver.Value, n int64, u uint64, isUint bool) (int64, error) {
+	bits, unsigned := 64, isUnsignedParquetColumn(c)
+	switch c.converted {
+	case parquetInt8, parquetUint8:
+		bits = 8
+	case parquetInt16, parquetUint16:
+		bits = 16
+	default:
+		if c.typ == parquetInt32 {
+			bits = 32
+		}
+	}
+	kind := "signed"
+	if unsigned {
+		kind = "unsigned"
+	}
+	outOfRange := errors.Errorf("value %v is out of the range of %s %d-bit integers", v, kind, bits)
+	if unsigned {
+		if !isUint {
+			if n < 0 {
+				return 0, outOfRange
+			}
+			u = uint64(n)
+		}
+		if bits < 64 && u >= 1<<bits {
+			return 0, outOfRange
+		}
+		return int64(u), nil
+	}
+	if isUint {
+		if u > math.MaxInt64 {
+			return 0, outOfRange
+		}
+		n = int64(u)
+	}
+	if bits < 64 && (n < -1<<(bits-1) || n >= 1<<(bits-1)) {
+		return 0, outOfRange
+	}
+	return n, nil
+}
+
+// parquetTime parses the date and timestamp strings as UTC.
+func parquetTime(v driver.Value) (time.Time, error) {
+	switch val := v.(type) {
+	case time.Time:
+		return val, nil
+	case string:
+		for _, layout := range parquetTimeLayouts {
+			if t, err := time.Parse(layout, val); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, errors.Errorf("invalid time %q", val)
+	}
+	return time.Time{}, errors.Errorf("unsupported value %v of type %T", v, v)
+}
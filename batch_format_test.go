@@ -0,0 +1,360 @@
+package godatabend
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+func TestNDJSONBatchEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := newBatchEncoder(BatchFormatNDJSON, &buf, []batchColumn{
+		{name: "id", typ: "BIGINT"},
+		{name: "name", typ: "VARCHAR", nullable: true},
+		{name: "tags", typ: "ARRAY(STRING)"},
+		{name: "v", typ: "VARIANT"},
+		{name: "d", typ: "DATE"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode([]driver.Value{int64(1), "a\"b", `["x","y"]`, `{"k":1}`, time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)}))
+	require.NoError(t, enc.Encode([]driver.Value{int64(2), nil, "[]", "not json", "2021-01-03"}))
+	require.NoError(t, enc.Close())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, []string{
+		`{"id":1,"name":"a\"b","tags":["x","y"],"v":{"k":1},"d":"2021-01-02"}`,
+		`{"id":2,"name":null,"tags":[],"v":"not json","d":"2021-01-03"}`,
+	}, lines)
+}
+
+func TestParquetBatchEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := newBatchEncoder(BatchFormatParquet, &buf, []batchColumn{
+		{name: "id", typ: "BIGINT"},
+		{name: "name", typ: "VARCHAR", nullable: true},
+		{name: "d", typ: "DATE", nullable: true},
+	})
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode([]driver.Value{int64(1), "a", "2021-01-02"}))
+	require.NoError(t, enc.Encode([]driver.Value{"2", nil, nil}))
+	assert.Error(t, enc.Encode([]driver.Value{nil, "c", nil}))
+	assert.Error(t, enc.Encode([]driver.Value{"x", "c", nil}))
+	require.NoError(t, enc.Close())
+
+	data := buf.Bytes()
+	require.True(t, len(data) > 12)
+	assert.Equal(t, parquetMagic, data[:4])
+	assert.Equal(t, parquetMagic, data[len(data)-4:])
+	footerLen := int(binary.LittleEndian.Uint32(data[len(data)-8 : len(data)-4]))
+	assert.Less(t, footerLen, len(data)-12)
+	footer := (&thriftReader{data: data[len(data)-8-footerLen : len(data)-8]}).structValue()
+
+	// the rejected rows leave nothing behind
+	assert.Equal(t, int64(2), footer[3])
+	rowGroups := footer[4].([]interface{})
+	require.Len(t, rowGroups, 1)
+	rowGroup := rowGroups[0].(map[int16]interface{})
+	assert.Equal(t, int64(2), rowGroup[3])
+	chunks := rowGroup[1].([]interface{})
+	require.Len(t, chunks, 3)
+	var pages [][]byte
+	for _, chunk := range chunks {
+		meta := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+		assert.Equal(t, int64(2), meta[5])
+		page := &thriftReader{data: data[meta[9].(int64):]}
+		header := page.structValue()
+		assert.Equal(t, int64(2), header[5].(map[int16]interface{})[1])
+		pages = append(pages, page.data[page.pos:page.pos+int(header[3].(int64))])
+	}
+
+	// id: two required int64 values
+	assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(pages[0][:8]))
+	assert.Equal(t, uint64(2), binary.LittleEndian.Uint64(pages[0][8:]))
+	// name: the definition levels of a value and a null, then the value
+	levelsLen := int(binary.LittleEndian.Uint32(pages[1][:4]))
+	assert.Equal(t, []byte{0x03, 0x01}, pages[1][4:4+levelsLen])
+	assert.Equal(t, []byte{1, 0, 0, 0, 'a'}, pages[1][4+levelsLen:])
+}
+
+// TestParquetBatchEncoderRoundTrip reads the written file with an independent parquet
+// implementation, over several row groups.
+func TestParquetBatchEncoderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := newBatchEncoder(BatchFormatParquet, &buf, []batchColumn{
+		{name: "id", typ: "BIGINT"},
+		{name: "name", typ: "VARCHAR", nullable: true},
+		{name: "ok", typ: "BOOLEAN", nullable: true},
+		{name: "score", typ: "DOUBLE"},
+		{name: "d", typ: "DATE"},
+		{name: "amount", typ: "DECIMAL(20, 2)"},
+		{name: "v", typ: "VARIANT"},
+	})
+	require.NoError(t, err)
+	enc.(*parquetBatchEncoder).w.rowGroupRows = 2
+	for i := 0; i < 5; i++ {
+		var name, ok driver.Value
+		if i%2 == 0 {
+			name, ok = fmt.Sprintf("n%d", i), i%4 == 0
+		}
+		row := []driver.Value{int64(i), name, ok, float64(i) / 2, time.Date(1970, 1, 1+i, 0, 0, 0, 0, time.UTC), fmt.Sprintf("-%d.5", i), fmt.Sprintf(`{"i":%d}`, i)}
+		require.NoError(t, enc.Encode(row))
+	}
+	require.NoError(t, enc.Close())
+
+	pr, err := reader.NewParquetColumnReader(&bytesParquetFile{Reader: bytes.NewReader(buf.Bytes()), data: buf.Bytes()}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), pr.GetNumRows())
+	assert.Len(t, pr.Footer.RowGroups, 3)
+	schema := pr.Footer.Schema
+	require.Len(t, schema, 8)
+	assert.Equal(t, parquet.ConvertedType_DATE, *schema[5].ConvertedType)
+	assert.Equal(t, parquet.ConvertedType_DECIMAL, *schema[6].ConvertedType)
+	assert.Equal(t, int32(20), *schema[6].Precision)
+	assert.Equal(t, int32(2), *schema[6].Scale)
+	assert.Equal(t, parquet.ConvertedType_JSON, *schema[7].ConvertedType)
+
+	read := func(index int64) ([]interface{}, []int32) {
+		values, _, dls, err := pr.ReadColumnByIndex(index, 5)
+		require.NoError(t, err)
+		return values, dls
+	}
+	ids, _ := read(0)
+	assert.Equal(t, []interface{}{int64(0), int64(1), int64(2), int64(3), int64(4)}, ids)
+	names, dls := read(1)
+	assert.Equal(t, []interface{}{"n0", nil, "n2", nil, "n4"}, names)
+	assert.Equal(t, []int32{1, 0, 1, 0, 1}, dls)
+	oks, _ := read(2)
+	assert.Equal(t, []interface{}{true, nil, false, nil, true}, oks)
+	scores, _ := read(3)
+	assert.Equal(t, []interface{}{0.0, 0.5, 1.0, 1.5, 2.0}, scores)
+	dates, _ := read(4)
+	assert.Equal(t, []interface{}{int32(0), int32(1), int32(2), int32(3), int32(4)}, dates)
+	amounts, _ := read(5)
+	require.Len(t, amounts, 5)
+	for i, amount := range amounts {
+		unscaled := new(big.Int).SetBytes([]byte(amount.(string)))
+		// the two's complement of the negative values
+		unscaled.Sub(unscaled, new(big.Int).Lsh(big.NewInt(1), uint(len(amount.(string))*8)))
+		assert.Equal(t, int64(-i*100-50), unscaled.Int64())
+	}
+	variants, _ := read(6)
+	assert.Equal(t, []interface{}{`{"i":0}`, `{"i":1}`, `{"i":2}`, `{"i":3}`, `{"i":4}`}, variants)
+}
+
+// bytesParquetFile is a read only source.ParquetFile of an in-memory file.
+type bytesParquetFile struct {
+	*bytes.Reader
+	data []byte
+}
+
+func (f *bytesParquetFile) Open(string) (source.ParquetFile, error) {
+	return &bytesParquetFile{Reader: bytes.NewReader(f.data), data: f.data}, nil
+}
+
+func (f *bytesParquetFile) Create(string) (source.ParquetFile, error) {
+	return nil, errors.New("read only")
+}
+
+func (f *bytesParquetFile) Write([]byte) (int, error) {
+	return 0, errors.New("read only")
+}
+
+func (f *bytesParquetFile) Close() error {
+	return nil
+}
+
+// thriftReader decodes the structs written by thriftWriter into maps by field id.
+type thriftReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		v := r.uvarint()
+		return int64(v>>1) ^ -int64(v&1)
+	case thriftBinary:
+		n := int(r.uvarint())
+		r.pos += n
+		return r.data[r.pos-n : r.pos]
+	case thriftList:
+		h := r.data[r.pos]
+		r.pos++
+		size := int(h >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.structValue()
+	}
+	panic(fmt.Sprintf("unexpected thrift type %d", typ))
+}
+
+func (r *thriftReader) structValue() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	var last int16
+	for {
+		h := r.data[r.pos]
+		r.pos++
+		if h == 0 {
+			return fields
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			v := r.uvarint()
+			id = int16(int64(v>>1) ^ -int64(v&1))
+		}
+		fields[id] = r.value(h & 0x0f)
+		last = id
+	}
+}
+
+func TestParquetValue(t *testing.T) {
+	for _, c := range []struct {
+		typ   string
+		value driver.Value
+		want  interface{}
+	}{
+		{"DATE", "1970-01-11", int32(10)},
+		{"TIMESTAMP", "1970-01-01 00:00:01.5", int64(1500000)},
+		{"BIGINT UNSIGNED", "18446744073709551615", int64(-1)},
+		{"FLOAT", int64(3), float32(3)},
+		// the unscaled decimals in the smallest physical type of the precision
+		{"DECIMAL(9, 2)", 3.25, int32(325)},
+		{"DECIMAL(9, 2)", 0.1 + 0.2, int32(30)},
+		{"DECIMAL(18, 3)", "-1.5", int64(-1500)},
+		{"DECIMAL(38, 0)", "1e20", []byte{0x05, 0x6b, 0xc7, 0x5e, 0x2d, 0x63, 0x10, 0x00, 0x00}},
+		{"DECIMAL(38, 1)", int64(-128), []byte{0xfb, 0x00}},
+		{"VARIANT", `{"k":[1,2]}`, []byte(`{"k":[1,2]}`)},
+		{"VARIANT", "not json", []byte(`"not json"`)},
+		{"VARIANT", int64(1), []byte("1")},
+	} {
+		column, err := newParquetColumn(batchColumn{name: "c", typ: c.typ})
+		require.NoError(t, err, c.typ)
+		v, err := parquetValue(column, c.value)
+		require.NoError(t, err, "%s %v", c.typ, c.value)
+		assert.Equal(t, c.want, v, "%s %v", c.typ, c.value)
+	}
+
+	for _, c := range []struct {
+		typ   string
+		value driver.Value
+	}{
+		{"DECIMAL(9, 2)", "1.234"},
+		{"DECIMAL(9, 2)", "10000000"},
+		{"DECIMAL(9, 2)", "1/2"},
+		{"DECIMAL(9, 2)", "abc"},
+	} {
+		column, err := newParquetColumn(batchColumn{name: "c", typ: c.typ})
+		require.NoError(t, err, c.typ)
+		_, err = parquetValue(column, c.value)
+		assert.Error(t, err, "%s %v", c.typ, c.value)
+	}
+
+	for _, typ := range []string{"ARRAY(INT32)", "MAP(STRING, INT32)", "TUPLE(INT32, STRING)", "DECIMAL", "DECIMAL(2, 3)"} {
+		_, err := newParquetColumn(batchColumn{name: "c", typ: typ})
+		assert.Error(t, err, typ)
+	}
+}
+
+func TestParquetIntRange(t *testing.T) {
+	column := func(typ string) *parquetColumn {
+		c, err := newParquetColumn(batchColumn{name: "n", typ: typ})
+		require.NoError(t, err)
+		return c
+	}
+	for _, c := range []struct {
+		typ   string
+		value driver.Value
+		want  interface{}
+	}{
+		{"TINYINT", int64(-128), int32(-128)},
+		{"TINYINT", "127", int32(127)},
+		{"SMALLINT", int64(-32768), int32(-32768)},
+		{"INT", int64(math.MaxInt32), int32(math.MaxInt32)},
+		{"BIGINT", "-9223372036854775808", int64(math.MinInt64)},
+		{"TINYINT UNSIGNED", int64(255), int32(255)},
+		{"INT UNSIGNED", int64(math.MaxUint32), int32(-1)},
+		{"BIGINT UNSIGNED", uint64(math.MaxUint64), int64(-1)},
+		{"BIGINT", 3e9, int64(3e9)},
+	} {
+		v, err := parquetValue(column(c.typ), c.value)
+		require.NoError(t, err, "%s %v", c.typ, c.value)
+		assert.Equal(t, c.want, v, "%s %v", c.typ, c.value)
+	}
+
+	for _, c := range []struct {
+		typ   string
+		value driver.Value
+	}{
+		{"TINYINT", int64(300)},
+		{"TINYINT", "-129"},
+		{"SMALLINT", int64(40000)},
+		{"INT", 3e9},
+		{"INT", "-3000000000"},
+		{"BIGINT", "9223372036854775808"},
+		{"BIGINT", uint64(math.MaxUint64)},
+		{"TINYINT UNSIGNED", int64(256)},
+		{"SMALLINT UNSIGNED", int64(-1)},
+		{"INT UNSIGNED", int64(math.MaxUint32 + 1)},
+		{"BIGINT UNSIGNED", int64(-1)},
+		{"BIGINT UNSIGNED", "-1"},
+		{"BIGINT", 1.5},
+	} {
+		_, err := parquetValue(column(c.typ), c.value)
+		assert.Error(t, err, "%s %v", c.typ, c.value)
+	}
+}
+
+func TestBatchInsertNDJSON(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		if strings.HasPrefix(req.SQL, "DESC") {
+			return `{"id":"q0","state":"Succeeded","data":[["a","BIGINT","NO","0",""],["b","VARCHAR","YES","NULL",""]]}`
+		}
+		return `{"id":"q1","state":"Succeeded"}`
+	}
+
+	dc := newTestConn(t, srv.URL)
+	ctx := context.WithValue(context.Background(), ContextKeyBatchFormat, BatchFormatNDJSON)
+	b, err := dc.prepareBatch(ctx, "INSERT INTO t (b, a) VALUES")
+	require.NoError(t, err)
+	require.NoError(t, b.AppendToFile([]driver.Value{"x", int64(1)}))
+	require.NoError(t, b.BatchInsert())
+
+	require.Len(t, srv.queries, 2)
+	assert.Equal(t, "DESC t", srv.queries[0].SQL)
+	assert.Equal(t, map[string]string{"type": "NDJSON"}, srv.queries[1].StageAttachment.FileFormatOptions)
+	require.Len(t, srv.uploads, 1)
+	for name, data := range srv.uploads {
+		assert.True(t, strings.HasSuffix(name, ".ndjson"))
+		assert.Equal(t, `{"b":"x","a":1}`+"\n", string(data))
+	}
+}
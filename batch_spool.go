@@ -0,0 +1,284 @@
+package godatabend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/avast/retry-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	spoolManifestFile = "manifest.json"
+	// a spooled batch failed this many times is left in place for manual inspection
+	maxSpoolAttempts = 5
+	// a directory without a manifest younger than this may be a batch being prepared
+	spoolOrphanAge = time.Minute
+)
+
+// liveSpools holds the ids of the spooled batches owned by the batches of this process.
+var liveSpools sync.Map
+
+type spoolState string
+
+const (
+	// the rows are still being appended, the batch was never committed, the files cut
+	// so far are complete on disk
+	spoolStateAppending spoolState = "appending"
+	// Commit has started, all the files are complete on disk
+	spoolStateCommitting spoolState = "committing"
+)
+
+// spoolManifest describes a batch insert spooled on disk, it's saved along with the
+// batch files in the directory of the batch under Config.BatchSpoolDir.
+type spoolManifest struct {
+	ID                string            `json:"id"`
+	SQL               string            `json:"sql"`
+	Format            BatchFormat       `json:"format"`
+	FileFormatOptions map[string]string `json:"file_format_options"`
+	StageName         string            `json:"stage_name"`
+	StagePath         string            `json:"stage_path"`
+	Files             []string          `json:"files"`
+	DeduplicateLabel  string            `json:"deduplicate_label,omitempty"`
+	State             spoolState        `json:"state"`
+	Attempts          int               `json:"attempts"`
+	CreatedAt         time.Time         `json:"created_at"`
+	// Host and PID are of the process owning the batch, its spool is only recovered once
+	// the process is gone
+	Host string `json:"host"`
+	PID  int    `json:"pid"`
+
+	dir string
+}
+
+// spoolDeduplicateLabel is the deduplicate label of a spooled batch without one given by
+// the caller or derived from its content.
+func spoolDeduplicateLabel(id string) string {
+	return "batch-" + id
+}
+
+// mayBeApplied reports whether the insert or the commit failed with the error may have
+// been applied by the server anyway, like a request whose response is lost, or one the
+// caller stopped waiting for. The other errors are returned by the server rejecting it.
+func mayBeApplied(ctx context.Context, err error) bool {
+	var retryErr retry.Error
+	if errors.As(err, &retryErr) {
+		// any of the attempts may have been applied
+		for _, err := range retryErr {
+			if err != nil && mayBeApplied(ctx, err) {
+				return true
+			}
+		}
+		return false
+	}
+	return isContextError(ctx, err) || errors.Is(err, ErrDoRequest) || errors.Is(err, ErrReadResponse)
+}
+
+func (m *spoolManifest) stage() *StageLocation {
+	return &StageLocation{Name: m.StageName, Path: m.StagePath}
+}
+
+// save writes the manifest atomically, so a crash never leaves a torn manifest.
+func (m *spoolManifest) save() error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "marshal spool manifest failed")
+	}
+	tmp := filepath.Join(m.dir, spoolManifestFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "create spool manifest failed")
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "write spool manifest failed")
+	}
+	return os.Rename(tmp, filepath.Join(m.dir, spoolManifestFile))
+}
+
+// own makes the batch owned by this process until it's released or removed.
+func (m *spoolManifest) own() {
+	m.Host, _ = os.Hostname()
+	m.PID = os.Getpid()
+	liveSpools.Store(m.ID, struct{}{})
+}
+
+// release gives up the batch of this process, it's kept on disk for RecoverSpool.
+func (m *spoolManifest) release() {
+	liveSpools.Delete(m.ID)
+}
+
+func (m *spoolManifest) remove() error {
+	m.release()
+	return os.RemoveAll(m.dir)
+}
+
+// owned reports whether the batch is owned by a live batch of this process or by
+// another live process. The processes of the other hosts can't be checked, so their
+// batches are left to be recovered on their hosts.
+func (m *spoolManifest) owned() bool {
+	if m.Host == "" && m.PID == 0 {
+		return false
+	}
+	if host, _ := os.Hostname(); m.Host != host {
+		return true
+	}
+	if m.PID == os.Getpid() {
+		_, ok := liveSpools.Load(m.ID)
+		return ok
+	}
+	return processAlive(m.PID)
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// the process is found only if it's running on windows, the signal 0 checks it on unix
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func loadSpoolManifest(dir string) (*spoolManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, spoolManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &spoolManifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, errors.Wrapf(err, "invalid spool manifest in %s", dir)
+	}
+	m.dir = dir
+	return m, nil
+}
+
+// RecoverSpool resumes the batch inserts left in Config.BatchSpoolDir of the db by a
+// process gone, such as crashed, or by a Commit whose outcome is unknown, such as its
+// request failed by the network. Those batches are uploaded and inserted again, the ones
+// of a crashed process never committed are inserted with the files cut before the
+// crash. The batches of the live processes are left alone, and so are the ones of the
+// other hosts. It returns the ids of the recovered batches. Only one process should
+// recover a spool directory at a time.
+func RecoverSpool(ctx context.Context, db *sql.DB) ([]string, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var recovered []string
+	err = conn.Raw(func(driverConn interface{}) error {
+		dc, ok := driverConn.(*DatabendConn)
+		if !ok {
+			return errors.New("not a databend connection")
+		}
+		recovered, err = dc.recoverSpool(ctx)
+		return err
+	})
+	return recovered, err
+}
+
+func (dc *DatabendConn) recoverSpool(ctx context.Context) ([]string, error) {
+	if dc.cfg == nil || dc.cfg.BatchSpoolDir == "" {
+		return nil, errors.New("batch spool dir is not configured")
+	}
+	entries, err := os.ReadDir(dc.cfg.BatchSpoolDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "read spool dir failed")
+	}
+
+	var (
+		recovered []string
+		firstErr  error
+	)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(dc.cfg.BatchSpoolDir, entry.Name())
+		m, err := loadSpoolManifest(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// crashed before the manifest was saved, there is nothing to recover
+				if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > spoolOrphanAge {
+					_ = os.RemoveAll(dir)
+				}
+				continue
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if m.owned() {
+			continue
+		}
+		if len(m.Files) == 0 {
+			// crashed before a file was cut, there is nothing to insert
+			_ = m.remove()
+			continue
+		}
+		if m.Attempts >= maxSpoolAttempts {
+			if firstErr == nil {
+				firstErr = errors.Errorf("spooled batch %s failed %d times", m.ID, m.Attempts)
+			}
+			continue
+		}
+		if err = dc.recoverSpoolBatch(ctx, m); err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "recover spooled batch %s failed", m.ID)
+			}
+			continue
+		}
+		recovered = append(recovered, m.ID)
+	}
+	return recovered, firstErr
+}
+
+func (dc *DatabendConn) recoverSpoolBatch(ctx context.Context, m *spoolManifest) error {
+	m.own()
+	defer m.release()
+	m.Attempts++
+	if err := m.save(); err != nil {
+		return err
+	}
+	for _, name := range m.Files {
+		stage := &StageLocation{Name: m.StageName, Path: m.StagePath + name}
+		if err := dc.uploadSpoolFile(ctx, filepath.Join(m.dir, name), stage); err != nil {
+			return errors.Wrap(err, "upload to stage failed")
+		}
+	}
+	// the label makes it safe to insert again if the crashed process has inserted already
+	label := m.DeduplicateLabel
+	if label == "" {
+		label = spoolDeduplicateLabel(m.ID)
+	}
+	ctx = context.WithValue(ctx, ContextKeyDeduplicateLabel, label)
+	if _, err := dc.rest.InsertWithStage(ctx, m.SQL, m.stage(), m.FileFormatOptions, nil); err != nil {
+		return errors.Wrap(err, "insert with stage failed")
+	}
+	return m.remove()
+}
+
+func (dc *DatabendConn) uploadSpoolFile(ctx context.Context, path string, stage *StageLocation) error {
+	return dc.rest.UploadFileToStage(dc.rest.checkQueryID(ctx), stage, path, nil)
+}
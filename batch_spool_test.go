@@ -0,0 +1,295 @@
+package godatabend
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchSpoolRemovedAfterInsert(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	dc.cfg.BatchSpoolDir = t.TempDir()
+	b, err := dc.prepareBatch(context.Background(), "INSERT INTO t VALUES")
+	require.NoError(t, err)
+	batch := b.(*httpBatch)
+
+	require.NoError(t, batch.AppendToFile([]driver.Value{1, "a"}))
+	m, err := loadSpoolManifest(batch.spool.dir)
+	require.NoError(t, err)
+	assert.Equal(t, spoolStateAppending, m.State)
+	assert.Equal(t, "INSERT INTO t VALUES", m.SQL)
+
+	require.NoError(t, batch.BatchInsert())
+	_, err = os.Stat(batch.spool.dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBatchSpoolRemovedAfterTxCommit(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	spoolDir := t.TempDir()
+	var spooledAtCommit []os.DirEntry
+	srv.onQuery = func(req QueryRequest) string {
+		if req.SQL == "COMMIT" {
+			spooledAtCommit, _ = os.ReadDir(spoolDir)
+		}
+		return echoSession(req)
+	}
+
+	dc := newTestConn(t, srv.URL)
+	dc.cfg.BatchSpoolDir = spoolDir
+	tx, err := dc.BeginTx(context.Background(), driver.TxOptions{})
+	require.NoError(t, err)
+	stmt, err := dc.PrepareContext(context.Background(), "INSERT INTO t VALUES")
+	require.NoError(t, err)
+	_, err = stmt.(*databendStmt).Exec([]driver.Value{1, "a"})
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	assert.Equal(t, []string{"BEGIN", "INSERT INTO t VALUES", "COMMIT"}, srv.sentSQL())
+	// the inserted rows are not durable until the transaction is committed
+	assert.Len(t, spooledAtCommit, 1)
+	entries, err := os.ReadDir(spoolDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestBatchSpoolRemovedOnRejectedCommit(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		return `{"id":"q1","state":"Failed","error":{"code":1025,"message":"Unknown table t"}}`
+	}
+
+	dc := newTestConn(t, srv.URL)
+	dc.cfg.BatchSpoolDir = t.TempDir()
+	b, err := dc.prepareBatch(context.Background(), "INSERT INTO t VALUES")
+	require.NoError(t, err)
+	batch := b.(*httpBatch)
+	require.NoError(t, batch.AppendToFile([]driver.Value{1, "a"}))
+	assert.ErrorContains(t, batch.BatchInsert(), "Unknown table t")
+
+	// the caller was told the batch failed, so it's not inserted by the recovery
+	_, err = os.Stat(batch.spool.dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBatchSpoolKeptOnUnknownCommit(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string { return runningQuery }
+	srv.onPage = blockPages
+
+	dc := newTestConn(t, srv.URL)
+	dc.cfg.BatchSpoolDir = t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	b, err := dc.prepareBatch(ctx, "INSERT INTO t VALUES")
+	require.NoError(t, err)
+	batch := b.(*httpBatch)
+	require.NoError(t, batch.AppendToFile([]driver.Value{1, "a"}))
+	assert.Error(t, batch.BatchInsert())
+
+	// the insert was sent but its outcome is unknown
+	m, err := loadSpoolManifest(batch.spool.dir)
+	require.NoError(t, err)
+	assert.Equal(t, spoolStateCommitting, m.State)
+	assert.Equal(t, []string{"part-00001.csv"}, m.Files)
+	// the label makes the recovery safe even if the insert was applied
+	assert.Equal(t, "batch-"+m.ID, m.DeduplicateLabel)
+
+	srv.onQuery = nil
+	srv.onPage = nil
+	srv.queries = nil
+	recovered, err := dc.recoverSpool(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{m.ID}, recovered)
+	require.Len(t, srv.queries, 1)
+	var session SessionState
+	require.NoError(t, json.Unmarshal(*srv.queries[0].Session, &session))
+	assert.Equal(t, "batch-"+m.ID, session.Settings[DEDUPLICATE_LABEL])
+}
+
+func TestBatchSpoolOfTxCommit(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		commit string
+		kept   bool
+	}{
+		{"rejected", `{"id":"q1","state":"Failed","error":{"code":4001,"message":"conflict"}}`, false},
+		{"unknown", runningQuery, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.Close()
+			srv.onQuery = func(req QueryRequest) string {
+				if req.SQL == "COMMIT" {
+					return c.commit
+				}
+				return echoSession(req)
+			}
+			srv.onPage = blockPages
+
+			spoolDir := t.TempDir()
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			dc := newTestConn(t, srv.URL)
+			dc.ctx = ctx
+			dc.cfg.BatchSpoolDir = spoolDir
+			tx, err := dc.BeginTx(context.Background(), driver.TxOptions{})
+			require.NoError(t, err)
+			stmt, err := dc.PrepareContext(context.Background(), "INSERT INTO t VALUES")
+			require.NoError(t, err)
+			_, err = stmt.(*databendStmt).Exec([]driver.Value{1, "a"})
+			require.NoError(t, err)
+			assert.Error(t, tx.Commit())
+
+			entries, err := os.ReadDir(spoolDir)
+			require.NoError(t, err)
+			if c.kept {
+				assert.Len(t, entries, 1)
+			} else {
+				assert.Empty(t, entries)
+			}
+		})
+	}
+}
+
+func TestRecoverSpool(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	spoolDir := t.TempDir()
+
+	dc := newTestConn(t, srv.URL)
+	dc.cfg.BatchSpoolDir = spoolDir
+	dc.cfg.BatchMaxRows = 2
+	prepare := func(values ...string) *httpBatch {
+		b, err := dc.prepareBatch(context.Background(), "INSERT INTO t VALUES")
+		require.NoError(t, err)
+		batch := b.(*httpBatch)
+		for i, value := range values {
+			require.NoError(t, batch.AppendToFile([]driver.Value{i, value}))
+		}
+		require.NoError(t, batch.pool.wait())
+		return batch
+	}
+
+	// the process crashes after Commit has started
+	committing := prepare("a", "a", "a")
+	require.NoError(t, committing.cutFile())
+	require.NoError(t, committing.pool.wait())
+	committing.spool.State = spoolStateCommitting
+	require.NoError(t, committing.spool.save())
+	committing.spool.release()
+	// and while the rows of other batches are appended, the files cut are inserted
+	appending := prepare("b", "b", "b")
+	appending.spool.release()
+	empty := prepare("c")
+	empty.spool.release()
+	// the batches still owned by this process, another process or another host are left
+	live := prepare("d", "d")
+	otherProcess := prepare("e", "e")
+	otherProcess.spool.PID = os.Getppid()
+	require.NoError(t, otherProcess.spool.save())
+	otherProcess.spool.release()
+	otherHost := prepare("f", "f")
+	otherHost.spool.Host = "other-host"
+	require.NoError(t, otherHost.spool.save())
+	otherHost.spool.release()
+
+	srv.uploads = map[string][]byte{}
+	srv.queries = nil
+
+	dsn := fmt.Sprintf("http://root:@%s/?batch_spool_dir=%s&presigned_url_disabled=1", strings.TrimPrefix(srv.URL, "http://"), spoolDir)
+	db, err := sql.Open("databend", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	recovered, err := RecoverSpool(context.Background(), db)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{committing.spool.ID, appending.spool.ID}, recovered)
+
+	assert.Len(t, srv.uploads, 3)
+	assert.Equal(t, "0,a\n1,a\n", string(srv.uploads[committing.stage.Path+"part-00001.csv"]))
+	assert.Equal(t, "2,a\n", string(srv.uploads[committing.stage.Path+"part-00002.csv"]))
+	// the row appended after the last cut file is lost
+	assert.Equal(t, "0,b\n1,b\n", string(srv.uploads[appending.stage.Path+"part-00001.csv"]))
+	require.Len(t, srv.queries, 2)
+	var locations []string
+	for _, query := range srv.queries {
+		assert.Equal(t, "INSERT INTO t VALUES", query.SQL)
+		locations = append(locations, query.StageAttachment.Location)
+	}
+	assert.ElementsMatch(t, []string{committing.stage.String(), appending.stage.String()}, locations)
+
+	entries, err := os.ReadDir(spoolDir)
+	require.NoError(t, err)
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	assert.ElementsMatch(t, []string{live.spool.ID, otherProcess.spool.ID, otherHost.spool.ID}, left)
+	_, err = os.Stat(filepath.Join(empty.spool.dir, spoolManifestFile))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBatchSpoolDiscardedOnRollback(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = echoSession
+
+	spoolDir := t.TempDir()
+	dc := newTestConn(t, srv.URL)
+	dc.cfg.BatchSpoolDir = spoolDir
+	dc.cfg.BatchMaxRows = 1
+	tx, err := dc.BeginTx(context.Background(), driver.TxOptions{})
+	require.NoError(t, err)
+	stmt, err := dc.PrepareContext(context.Background(), "INSERT INTO t VALUES")
+	require.NoError(t, err)
+	_, err = stmt.(*databendStmt).Exec([]driver.Value{1, "a"})
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+
+	entries, err := os.ReadDir(spoolDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Equal(t, []string{"BEGIN", "ROLLBACK"}, srv.sentSQL())
+}
+
+func TestBatchDeduplicateLabel(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	dc.cfg.BatchDeduplicate = true
+	insert := func(ctx context.Context, value string) string {
+		b, err := dc.prepareBatch(ctx, "INSERT INTO t VALUES")
+		require.NoError(t, err)
+		require.NoError(t, b.AppendToFile([]driver.Value{1, value}))
+		require.NoError(t, b.BatchInsert())
+		var session SessionState
+		require.NoError(t, json.Unmarshal(*srv.queries[len(srv.queries)-1].Session, &session))
+		return session.Settings[DEDUPLICATE_LABEL]
+	}
+
+	label := insert(context.Background(), "a")
+	assert.True(t, strings.HasPrefix(label, "batch-"))
+	assert.Equal(t, label, insert(context.Background(), "a"))
+	assert.NotEqual(t, label, insert(context.Background(), "b"))
+
+	ctx := context.WithValue(context.Background(), ContextKeyDeduplicateLabel, "my-label")
+	assert.Equal(t, "my-label", insert(ctx, "a"))
+}
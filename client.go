@@ -9,10 +9,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"mime/multipart"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -37,6 +39,7 @@ const (
 	Page
 	Final
 	Kill
+	Upload
 )
 
 type ContextKey string
@@ -44,9 +47,18 @@ type ContextKey string
 const (
 	ContextKeyQueryID  ContextKey = "X-DATABEND-QUERY-ID"
 	ContextUserAgentID ContextKey = "USER-AGENT"
+	// ContextKeyDeduplicateLabel sets the deduplicate_label setting of the queries started
+	// with the context, the server skips an insert whose label has been applied already,
+	// so the insert is safe to retry.
+	ContextKeyDeduplicateLabel ContextKey = "DEDUPLICATE-LABEL"
 
 	EMPTY_FIELD_AS string = "empty_field_as"
 	PURGE          string = "purge"
+
+	DEDUPLICATE_LABEL string = "deduplicate_label"
+	// MAX_EXECUTE_TIME_IN_SECONDS is set by the deadline of the query context, so the
+	// server stops the query even if the client is gone.
+	MAX_EXECUTE_TIME_IN_SECONDS string = "max_execute_time_in_seconds"
 )
 
 type PresignedResponse struct {
@@ -97,6 +109,17 @@ type APIClient struct {
 
 	sessionStateRaw *json.RawMessage
 	sessionState    *SessionState
+	// initialSessionStateRaw is the session of the config, which the session is reset to
+	// before the connection is reused by the pool.
+	initialSessionStateRaw json.RawMessage
+	// broken is set once a request of a query failed after all the retries, the session
+	// may be changed by the server without the client knowing it.
+	broken bool
+
+	// settingsOverride holds the settings set for the current query only, they are kept
+	// out of the session, settingsOriginal is the session values they have overridden.
+	settingsOverride map[string]string
+	settingsOriginal map[string]string
 
 	// routHint is used to save the route hint from the last responded X-Databend-Route-Hint, this is
 	// used for guiding the preferred route for the next following http requests, this is useful for
@@ -106,11 +129,22 @@ type APIClient struct {
 	statsTracker      QueryStatsTracker
 	accessTokenLoader AccessTokenLoader
 
+	queryIDGenerator QueryIDGenerator
+	queryIDPrefix    string
+	// queryID is the generated id of the current query started without ContextKeyQueryID
+	queryID string
+
 	WaitTimeSeconds      int64
 	MaxRowsInBuffer      int64
 	MaxRowsPerPage       int64
 	PresignedURLDisabled bool
 	EmptyFieldAs         string
+	UploadTimeout        time.Duration
+	UploadRetries        int
+	// UploadCompression compresses the data uploaded by the batch inserts and LoadReader,
+	// which set the matching compression option. The data of UploadToStage is uploaded as
+	// it is, it may already be compressed by the caller.
+	UploadCompression Compression
 
 	// only used for testing mocks
 	doRequestFunc func(method, path string, req interface{}, resp interface{}) error
@@ -121,10 +155,58 @@ func (c *APIClient) NextQuery() {
 		_ = c.rows.Close()
 	}
 	c.QuerySeq += 1
+	c.queryID = ""
 }
 
 func (c *APIClient) GetQueryID() string {
-	return fmt.Sprintf("%s.%d", c.SessionID, c.QuerySeq)
+	if c.queryIDGenerator == nil && c.queryIDPrefix == "" {
+		return fmt.Sprintf("%s.%d", c.SessionID, c.QuerySeq)
+	}
+	if c.queryID == "" {
+		c.queryID = c.newQueryID()
+	}
+	return c.queryID
+}
+
+// newQueryID generates a query id by the generator and the prefix of the config.
+func (c *APIClient) newQueryID() string {
+	if c == nil {
+		return uuid.NewString()
+	}
+	id := ""
+	if c.queryIDGenerator != nil {
+		id = c.queryIDGenerator()
+	} else {
+		id = uuid.NewString()
+	}
+	return c.queryIDPrefix + id
+}
+
+// checkQueryID checks if query_id exists in context, if not, generate a new one, so the
+// requests of the query made with the context carry the same id.
+func (c *APIClient) checkQueryID(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(ContextKeyQueryID).(string); !ok {
+		ctx = withGeneratedQueryID(ctx, c.newQueryID())
+	}
+	return ctx
+}
+
+// contextKeyGeneratedQueryID holds the query id generated by the client, so it's told
+// apart from the one given by the caller.
+type contextKeyGeneratedQueryID struct{}
+
+// withGeneratedQueryID returns the context of the query id generated by the client.
+func withGeneratedQueryID(ctx context.Context, queryID string) context.Context {
+	ctx = context.WithValue(ctx, ContextKeyQueryID, queryID)
+	return context.WithValue(ctx, contextKeyGeneratedQueryID{}, queryID)
+}
+
+// isGeneratedQueryID reports whether the query id of the context is generated by the
+// client, it's false if there is no query id.
+func isGeneratedQueryID(ctx context.Context) bool {
+	queryID, ok := ctx.Value(ContextKeyQueryID).(string)
+	generated, _ := ctx.Value(contextKeyGeneratedQueryID{}).(string)
+	return ok && queryID == generated
 }
 
 func NewAPIHttpClientFromConfig(cfg *Config) *http.Client {
@@ -180,14 +262,21 @@ func NewAPIClientFromConfig(cfg *Config) *APIClient {
 		sessionStateRaw: &sessionStateRaw,
 		routeHint:       randRouteHint(),
 
+		initialSessionStateRaw: sessionStateRawJson,
+
 		accessTokenLoader: initAccessTokenLoader(cfg),
 		statsTracker:      cfg.StatsTracker,
+		queryIDGenerator:  cfg.QueryIDGenerator,
+		queryIDPrefix:     cfg.QueryIDPrefix,
 
 		WaitTimeSeconds:      cfg.WaitTimeSecs,
 		MaxRowsInBuffer:      cfg.MaxRowsInBuffer,
 		MaxRowsPerPage:       cfg.MaxRowsPerPage,
 		PresignedURLDisabled: cfg.PresignedURLDisabled,
 		EmptyFieldAs:         cfg.EmptyFieldAs,
+		UploadTimeout:        cfg.UploadTimeout,
+		UploadRetries:        cfg.UploadRetries,
+		UploadCompression:    cfg.UploadCompression,
 	}
 }
 
@@ -223,14 +312,18 @@ func (c *APIClient) doRequest(ctx context.Context, method, path string, req inte
 	}
 	httpReq = httpReq.WithContext(ctx)
 
+	nodeID := c.NodeID
+	if id, ok := ctx.Value(contextKeyNodeID).(string); ok {
+		nodeID = id
+	}
 	maxRetries := 2
 	for i := 1; i <= maxRetries; i++ {
 		headers, err := c.makeHeaders(ctx)
 		if err != nil {
 			return errors.Wrap(err, "failed to make request headers")
 		}
-		if method == "GET" && len(c.NodeID) != 0 {
-			headers.Set(DatabendQueryIDNode, c.NodeID)
+		if method == "GET" && len(nodeID) != 0 {
+			headers.Set(DatabendQueryIDNode, nodeID)
 		}
 		headers.Set(contentType, jsonContentType)
 		headers.Set(accept, jsonContentType)
@@ -242,6 +335,10 @@ func (c *APIClient) doRequest(ctx context.Context, method, path string, req inte
 
 		httpResp, err := c.cli.Do(httpReq)
 		if err != nil {
+			if ctx.Err() != nil {
+				// not retried, the query context is done
+				return errors.Wrap(ctx.Err(), err.Error())
+			}
 			return errors.Wrap(ErrDoRequest, err.Error())
 		}
 		defer func() {
@@ -319,15 +416,26 @@ func (c *APIClient) makeHeaders(ctx context.Context) (http.Header, error) {
 	if c.warehouse != "" {
 		headers.Set(DatabendWarehouseHeader, c.warehouse)
 	}
-	if c.routeHint != "" {
+	if routeHint, ok := ctx.Value(contextKeyRouteHint).(string); ok {
+		headers.Set(DatabendRouteHintHeader, routeHint)
+	} else if c.routeHint != "" {
 		headers.Set(DatabendRouteHintHeader, c.routeHint)
 	}
 
-	if queryID, ok := ctx.Value(ContextKeyQueryID).(string); ok {
-		headers.Set(DatabendQueryIDHeader, queryID)
-	} else {
-		headers.Set(DatabendQueryIDHeader, c.GetQueryID())
+	// the generated ids are checked strictly, the ones of the caller only have to fit
+	// in the header
+	queryID, ok := ctx.Value(ContextKeyQueryID).(string)
+	validate := validateCallerQueryID
+	if !ok {
+		queryID = c.GetQueryID()
+		validate = validateQueryID
+	} else if isGeneratedQueryID(ctx) {
+		validate = validateQueryID
+	}
+	if err := validate(queryID); err != nil {
+		return nil, err
 	}
+	headers.Set(DatabendQueryIDHeader, queryID)
 
 	switch c.authMethod() {
 	case AuthMethodUserPassword:
@@ -360,15 +468,21 @@ var databendInsecureTransport = &http.Transport{
 	}).DialContext,
 }
 
-func (c *APIClient) getPagenationConfig() *PaginationConfig {
-	if c.MaxRowsPerPage == 0 && c.MaxRowsInBuffer == 0 && c.WaitTimeSeconds == 0 {
-		return nil
-	}
-	return &PaginationConfig{
+// getPagenationConfig returns the pagination of the connection with the one of the
+// context merged.
+func (c *APIClient) getPagenationConfig(ctx context.Context) *PaginationConfig {
+	cfg := PaginationConfig{
 		MaxRowsPerPage:  c.MaxRowsPerPage,
 		MaxRowsInBuffer: c.MaxRowsInBuffer,
 		WaitTime:        c.WaitTimeSeconds,
 	}
+	if override, ok := ctx.Value(contextKeyPagination{}).(PaginationConfig); ok {
+		cfg = mergePagination(cfg, override)
+	}
+	if cfg == (PaginationConfig{}) {
+		return nil
+	}
+	return &cfg
 }
 
 func (c *APIClient) getSessionStateRaw() *json.RawMessage {
@@ -379,36 +493,209 @@ func (c *APIClient) getSessionState() *SessionState {
 	return c.sessionState
 }
 
+// txnState returns the transaction state of the session reported by the server, it's
+// empty if the server has reported none.
+func (c *APIClient) txnState() TxnState {
+	if c.sessionState == nil {
+		return ""
+	}
+	for _, state := range []TxnState{TxnStateActive, TxnStateFail, TxnStateAutoCommit} {
+		if strings.EqualFold(string(c.sessionState.TxnState), string(state)) {
+			return state
+		}
+	}
+	return c.sessionState.TxnState
+}
+
+// inActiveTransaction reports whether the session is in a transaction not ended yet,
+// including the one aborted by a failed statement but not rolled back.
 func (c *APIClient) inActiveTransaction() bool {
-	return c.sessionState != nil && strings.EqualFold(string(c.sessionState.TxnState), string(TxnStateActive))
+	state := c.txnState()
+	return state == TxnStateActive || state == TxnStateFail
+}
+
+// resetSession reverts the session to the one of the config, the database, the role,
+// the settings and the transaction state changed by the queries are discarded.
+func (c *APIClient) resetSession() {
+	raw := append(json.RawMessage(nil), c.initialSessionStateRaw...)
+	state := SessionState{}
+	_ = json.Unmarshal(raw, &state)
+	c.sessionStateRaw = &raw
+	c.sessionState = &state
+	c.settingsOverride = nil
+	c.settingsOriginal = nil
+	c.routeHint = randRouteHint()
+}
+
+// checkBroken marks the client broken if the request failed by the network after all
+// the retries.
+func (c *APIClient) checkBroken(err error) {
+	if errors.Is(err, ErrDoRequest) || errors.Is(err, ErrReadResponse) {
+		c.broken = true
+	}
 }
 
 func (c *APIClient) applySessionState(response *QueryResponse) {
 	if response == nil || response.Session == nil {
 		return
 	}
-	c.sessionStateRaw = response.Session
-	_ = json.Unmarshal(*response.Session, c.sessionState)
+	c.setSessionStateRaw(response.Session)
+	if len(c.settingsOverride) > 0 {
+		c.restoreSessionSettings()
+	}
+}
+
+// querySettings returns the settings of the query from the context. The execution time is
+// limited by the deadline of the context and WithQueryTimeout, unless a shorter limit is
+// set by WithSettings or in the session.
+func querySettings(ctx context.Context, session map[string]string) map[string]string {
+	settings := map[string]string{}
+	for k, v := range contextSettings(ctx) {
+		settings[k] = v
+	}
+	if label, ok := ctx.Value(ContextKeyDeduplicateLabel).(string); ok && label != "" {
+		settings[DEDUPLICATE_LABEL] = label
+	}
+	var seconds int64
+	if timeout, ok := ctx.Value(contextKeyQueryTimeout{}).(time.Duration); ok && timeout > 0 {
+		seconds = deadlineSeconds(time.Now().Add(timeout))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if s := deadlineSeconds(deadline); seconds == 0 || s < seconds {
+			seconds = s
+		}
+	}
+	if seconds > 0 {
+		current, ok := settings[MAX_EXECUTE_TIME_IN_SECONDS]
+		if !ok {
+			current = session[MAX_EXECUTE_TIME_IN_SECONDS]
+		}
+		// 0 means no limit to the server
+		if n, err := strconv.ParseInt(current, 10, 64); err == nil && n > 0 && n < seconds {
+			seconds = n
+		}
+		settings[MAX_EXECUTE_TIME_IN_SECONDS] = strconv.FormatInt(seconds, 10)
+	}
+	return settings
+}
+
+// deadlineSeconds returns the seconds left before the deadline rounded up, at least 1
+// since 0 means no limit to the server.
+func deadlineSeconds(deadline time.Time) int64 {
+	seconds := int64(math.Ceil(time.Until(deadline).Seconds()))
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// isContextError reports whether the error is caused by the context being canceled or
+// timed out, the query is abandoned by the client then, so it should be killed.
+func isContextError(ctx context.Context, err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil
+}
+
+// makeSessionStateRaw returns the session of the query request with the query settings
+// from the context merged, the connection session is not changed.
+func (c *APIClient) makeSessionStateRaw(ctx context.Context) (*json.RawMessage, error) {
+	var session map[string]string
+	if c.sessionState != nil {
+		session = c.sessionState.Settings
+	}
+	settings := querySettings(ctx, session)
+	c.settingsOverride = nil
+	c.settingsOriginal = nil
+	if len(settings) == 0 {
+		return c.getSessionStateRaw(), nil
+	}
+	c.settingsOverride = settings
+	c.settingsOriginal = map[string]string{}
+	if c.sessionState != nil {
+		for k := range settings {
+			if v, ok := c.sessionState.Settings[k]; ok {
+				c.settingsOriginal[k] = v
+			}
+		}
+	}
+	return rewriteSessionSettings(c.getSessionStateRaw(), func(current map[string]string) {
+		for k, v := range settings {
+			current[k] = v
+		}
+	})
+}
+
+// restoreSessionSettings reverts the settings overridden by the current query in the
+// session responded by the server. The settings changed by the query itself, like by a
+// SET statement, are kept.
+func (c *APIClient) restoreSessionSettings() {
+	restore := func(current map[string]string) {
+		for k, sent := range c.settingsOverride {
+			if v, ok := current[k]; !ok || v != sent {
+				continue
+			}
+			if v, ok := c.settingsOriginal[k]; ok {
+				current[k] = v
+			} else {
+				delete(current, k)
+			}
+		}
+	}
+	if c.sessionState.Settings != nil {
+		restore(c.sessionState.Settings)
+	}
+	if raw, err := rewriteSessionSettings(c.sessionStateRaw, restore); err == nil {
+		c.sessionStateRaw = raw
+	}
+}
+
+// rewriteSessionSettings changes the settings of the raw session json, the other fields
+// are kept as they are, including the ones unknown to SessionState.
+func rewriteSessionSettings(raw *json.RawMessage, fn func(settings map[string]string)) (*json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	if raw != nil {
+		if err := json.Unmarshal(*raw, &fields); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal session state")
+		}
+	}
+	settings := map[string]string{}
+	if s, ok := fields["settings"]; ok {
+		if err := json.Unmarshal(s, &settings); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal session settings")
+		}
+	}
+	fn(settings)
+	if len(settings) > 0 {
+		buf, err := json.Marshal(settings)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal session settings")
+		}
+		fields["settings"] = buf
+	} else {
+		delete(fields, "settings")
+	}
+	buf, err := json.Marshal(fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal session state")
+	}
+	result := json.RawMessage(buf)
+	return &result, nil
 }
 
 func (c *APIClient) PollUntilQueryEnd(ctx context.Context, resp *QueryResponse) (*QueryResponse, error) {
-	var err error
 	for !resp.ReadFinished() {
-		data := resp.Data
-		resp, err = c.PollQuery(ctx, resp.NextURI)
+		next, err := c.PollQuery(ctx, resp.NextURI)
 		if err != nil {
-			if errors.Is(err, context.Canceled) {
-				// context might be canceled due to timeout or canceled. if it's canceled, we need call
-				// the kill url to tell the backend it's killed.
-				fmt.Printf("query canceled, kill query:%s", resp.ID)
+			if isContextError(ctx, err) {
+				// the query is still running on the server, kill it by the last response
 				_ = c.KillQuery(context.Background(), resp)
 			}
 			return nil, err
 		}
-		if resp.Error != nil {
-			return nil, errors.Wrap(resp.Error, "query page has error")
+		if next.Error != nil {
+			return nil, errors.Wrap(next.Error, "query page has error")
 		}
-		resp.Data = append(data, resp.Data...)
+		next.Data = append(resp.Data, next.Data...)
+		resp = next
 	}
 	return resp, nil
 }
@@ -433,7 +720,7 @@ func (c *APIClient) QuerySync(ctx context.Context, query string, args []driver.V
 		_ = c.CloseQuery(ctx, resp)
 	}()
 	if resp.Error != nil {
-		return nil, fmt.Errorf("query error: %+v", resp.Error)
+		return nil, errors.Wrap(resp.Error, "query error")
 	}
 	return c.PollUntilQueryEnd(ctx, resp)
 }
@@ -445,6 +732,9 @@ func (c *APIClient) doRetry(f retry.RetryableFunc, t RequestType) error {
 		delay = 2
 		attempts = 5
 	}
+	if t == Upload && c.UploadRetries > 0 {
+		attempts = uint(c.UploadRetries)
+	}
 	return retry.Do(
 		func() error {
 			return f()
@@ -453,7 +743,7 @@ func (c *APIClient) doRetry(f retry.RetryableFunc, t RequestType) error {
 			if err == nil {
 				return false
 			}
-			if errors.Is(err, context.Canceled) {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 				return false
 			}
 			if errors.Is(err, ErrDoRequest) || errors.Is(err, ErrReadResponse) || IsProxyErr(err) {
@@ -462,11 +752,17 @@ func (c *APIClient) doRetry(f retry.RetryableFunc, t RequestType) error {
 			if t == Query && strings.Contains(err.Error(), ProvisionWarehouseTimeout) {
 				return true
 			}
+			var apiErr APIError
+			if t == Upload && errors.As(err, &apiErr) && apiErr.StatusCode >= 500 {
+				return true
+			}
 			return false
 		}),
 		retry.Delay(delay*time.Second),
 		retry.Attempts(attempts),
 		retry.DelayType(retry.FixedDelay),
+		// the error of an upload is returned as it is, so it can be inspected by the caller
+		retry.LastErrorOnly(t == Upload),
 	)
 }
 
@@ -483,11 +779,20 @@ func (c *APIClient) startQueryRequest(ctx context.Context, request *QueryRequest
 		resp        QueryResponse
 		respHeaders http.Header
 	)
+	progress := progressObserverFrom(ctx)
+	if progress != nil {
+		queryID, _ := ctx.Value(ContextKeyQueryID).(string)
+		progress.start(queryID)
+	}
 	err := c.doRetry(func() error {
 		return c.doRequest(ctx, "POST", path, request, &resp, &respHeaders)
 	}, Query,
 	)
+	if progress != nil {
+		progress.observe(&resp, err)
+	}
 	if err != nil {
+		c.checkBroken(err)
 		return nil, errors.Wrap(err, "failed to do query request")
 	}
 
@@ -508,15 +813,33 @@ func (c *APIClient) StartQuery(ctx context.Context, query string, args []driver.
 	if err != nil {
 		return nil, err
 	}
+	session, err := c.makeSessionStateRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
 	request := QueryRequest{
 		SQL:        q,
-		Pagination: c.getPagenationConfig(),
-		Session:    c.getSessionStateRaw(),
+		Pagination: c.getPagenationConfig(ctx),
+		Session:    session,
 	}
 	return c.startQueryRequest(ctx, &request)
 }
 
 func (c *APIClient) PollQuery(ctx context.Context, nextURI string) (*QueryResponse, error) {
+	result, err := c.pollPage(ctx, nextURI)
+	// try update session as long as resp is not nil, even if query failed (resp.Error != nil)
+	// e.g. transaction state need to be updated if commit fail
+	c.applySessionState(result)
+	c.trackStats(result)
+	if err != nil {
+		c.checkBroken(err)
+		return nil, errors.Wrap(err, "failed to query page")
+	}
+	return result, nil
+}
+
+// pollPage requests the next page of a query, the session of the client is not changed.
+func (c *APIClient) pollPage(ctx context.Context, nextURI string) (*QueryResponse, error) {
 	var result QueryResponse
 	err := c.doRetry(
 		func() error {
@@ -524,14 +847,10 @@ func (c *APIClient) PollQuery(ctx context.Context, nextURI string) (*QueryRespon
 		},
 		Page,
 	)
-	// try update session as long as resp is not nil, even if query failed (resp.Error != nil)
-	// e.g. transaction state need to be updated if commit fail
-	c.applySessionState(&result)
-	c.trackStats(&result)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to query page")
+	if progress := progressObserverFrom(ctx); progress != nil {
+		progress.observe(&result, err)
 	}
-	return &result, nil
+	return &result, err
 }
 
 func (c *APIClient) KillQuery(ctx context.Context, response *QueryResponse) error {
@@ -568,10 +887,14 @@ func (c *APIClient) InsertWithStage(ctx context.Context, sql string, stage *Stag
 	if copyOptions == nil {
 		copyOptions = c.NewDefaultCopyOptions()
 	}
+	session, err := c.makeSessionStateRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
 	request := QueryRequest{
 		SQL:        sql,
-		Pagination: c.getPagenationConfig(),
-		Session:    c.getSessionStateRaw(),
+		Pagination: c.getPagenationConfig(ctx),
+		Session:    session,
 		StageAttachment: &StageAttachmentConfig{
 			Location:          stage.String(),
 			FileFormatOptions: fileFormatOptions,
@@ -591,6 +914,9 @@ func (c *APIClient) InsertWithStage(ctx context.Context, sql string, stage *Stag
 	return c.PollUntilQueryEnd(ctx, resp)
 }
 
+// UploadToStage uploads the input to the stage by a presigned url, or by the upload api
+// if Config.PresignedURLDisabled is set. The input can't be rewound, so a failed upload
+// is not retried, UploadFileToStage retries the failed uploads of a local file.
 func (c *APIClient) UploadToStage(ctx context.Context, stage *StageLocation, input *bufio.Reader, size int64) error {
 	if c.PresignedURLDisabled {
 		return c.UploadToStageByAPI(ctx, stage, input)
@@ -600,12 +926,21 @@ func (c *APIClient) UploadToStage(ctx context.Context, stage *StageLocation, inp
 }
 
 func (c *APIClient) GetPresignedURL(ctx context.Context, stage *StageLocation) (*PresignedResponse, error) {
-	presignUploadSQL := fmt.Sprintf("PRESIGN UPLOAD %s", stage)
-	resp, err := c.QuerySync(ctx, presignUploadSQL, nil)
+	return c.presign(ctx, "UPLOAD", stage)
+}
+
+// GetPresignedDownloadURL returns the presigned url to download the file of the stage.
+func (c *APIClient) GetPresignedDownloadURL(ctx context.Context, stage *StageLocation) (*PresignedResponse, error) {
+	return c.presign(ctx, "DOWNLOAD", stage)
+}
+
+func (c *APIClient) presign(ctx context.Context, action string, stage *StageLocation) (*PresignedResponse, error) {
+	presignSQL := fmt.Sprintf("PRESIGN %s %s", action, stage)
+	resp, err := c.QuerySync(ctx, presignSQL, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to query presign url")
 	}
-	if len(resp.Data) < 1 || len(resp.Data[0]) < 2 {
+	if len(resp.Data) < 1 || len(resp.Data[0]) < 3 {
 		return nil, errors.Errorf("generate presign url invalid response: %+v", resp.Data)
 	}
 	if resp.Data[0][0] == nil || resp.Data[0][1] == nil || resp.Data[0][2] == nil {
@@ -626,13 +961,20 @@ func (c *APIClient) GetPresignedURL(ctx context.Context, stage *StageLocation) (
 	return result, nil
 }
 
+// UploadToStageByPresignURL uploads the input to the stage by a presigned url, like
+// UploadToStage a failed upload is not retried.
 func (c *APIClient) UploadToStageByPresignURL(ctx context.Context, stage *StageLocation, input *bufio.Reader, size int64) error {
 	presigned, err := c.GetPresignedURL(ctx, stage)
 	if err != nil {
 		return errors.Wrap(err, "failed to get presigned url")
 	}
+	return c.uploadToPresignedURL(ctx, presigned, input, size)
+}
 
-	req, err := http.NewRequest("PUT", presigned.URL, input)
+// uploadToPresignedURL does not touch the client session, so it is safe to be called
+// concurrently once the presigned url is generated.
+func (c *APIClient) uploadToPresignedURL(ctx context.Context, presigned *PresignedResponse, input *bufio.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", presigned.URL, input)
 	if err != nil {
 		return err
 	}
@@ -640,47 +982,38 @@ func (c *APIClient) UploadToStageByPresignURL(ctx context.Context, stage *StageL
 		req.Header.Set(k, v)
 	}
 	req.ContentLength = size
-	// TODO: configurable timeout
-	httpClient := &http.Client{
-		Timeout: time.Second * 60,
-	}
-	resp, err := httpClient.Do(req)
+	resp, err := c.uploadHTTPClient().Do(req)
 	if err != nil {
-		return errors.Wrap(err, "failed to upload to stage by presigned url")
+		return errors.Wrap(ErrDoRequest, "failed to upload to stage by presigned url: "+err.Error())
 	}
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return errors.Wrap(ErrReadResponse, err.Error())
 	}
 	if resp.StatusCode >= 400 {
-		return errors.Errorf("failed to upload to stage by presigned url, status code: %d, body: %s", resp.StatusCode, string(respBody))
+		return NewAPIError("failed to upload to stage by presigned url", resp.StatusCode, respBody)
 	}
 	return nil
 }
 
 func (c *APIClient) UploadToStageByAPI(ctx context.Context, stage *StageLocation, input *bufio.Reader) error {
-	body := new(bytes.Buffer)
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("upload", stage.Path)
-	if err != nil {
-		return errors.Wrap(err, "failed to create multipart writer form file")
-	}
-	// TODO: do async upload
-	_, err = io.Copy(part, input)
-	if err != nil {
-		return errors.Wrap(err, "failed to copy file to multipart writer form file")
-	}
-	err = writer.Close()
-	if err != nil {
-		return errors.Wrap(err, "failed to close multipart writer")
-	}
+	return c.uploadToStageByAPI(ctx, stage, input, "")
+}
+
+// uploadToStageByAPI uploads the input to the stage by the upload api, the input is
+// compressed on the fly if the compression is given.
+func (c *APIClient) uploadToStageByAPI(ctx context.Context, stage *StageLocation, input io.Reader, compression Compression) error {
+	body, formContentType := newMultipartBody("upload", stage.Path, input, compression)
+	defer func() {
+		_ = body.Close()
+	}()
 
 	path := "/v1/upload_to_stage"
 	url := c.makeURL(path)
-	req, err := http.NewRequest("PUT", url, body)
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, body)
 	if err != nil {
 		return errors.Wrap(err, "failed to create http request")
 	}
@@ -693,15 +1026,11 @@ func (c *APIClient) UploadToStageByAPI(ctx context.Context, stage *StageLocation
 		req.Host = c.host
 	}
 	req.Header.Set("stage_name", stage.Name)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Content-Type", formContentType)
 
-	// TODO: configurable timeout
-	httpClient := &http.Client{
-		Timeout: time.Second * 60,
-	}
-	resp, err := httpClient.Do(req)
+	resp, err := c.uploadHTTPClient().Do(req)
 	if err != nil {
-		return errors.Wrap(err, "failed http do request")
+		return errors.Wrap(ErrDoRequest, "failed http do request: "+err.Error())
 	}
 	defer func() {
 		_ = resp.Body.Close()
@@ -709,7 +1038,7 @@ func (c *APIClient) UploadToStageByAPI(ctx context.Context, stage *StageLocation
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return errors.Wrap(err, "failed to read http response body")
+		return errors.Wrap(ErrReadResponse, "failed to read http response body: "+err.Error())
 	}
 
 	if resp.StatusCode == http.StatusUnauthorized {
@@ -723,6 +1052,42 @@ func (c *APIClient) UploadToStageByAPI(ctx context.Context, stage *StageLocation
 	return nil
 }
 
+// newMultipartBody streams the input as the file of a multipart form through a pipe, so
+// the input is never fully buffered in memory, it's compressed in the pipe if the
+// compression is given. The body must be closed by the caller.
+func newMultipartBody(field, fileName string, input io.Reader, compression Compression) (io.ReadCloser, string) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		part, err := writer.CreateFormFile(field, fileName)
+		if err != nil {
+			_ = pw.CloseWithError(errors.Wrap(err, "failed to create multipart writer form file"))
+			return
+		}
+		if compression != "" {
+			var zw io.WriteCloser
+			if zw, err = newCompressWriter(part, compression); err == nil {
+				if _, err = io.Copy(zw, input); err == nil {
+					err = zw.Close()
+				}
+			}
+		} else {
+			_, err = io.Copy(part, input)
+		}
+		if err != nil {
+			_ = pw.CloseWithError(errors.Wrap(err, "failed to copy file to multipart writer form file"))
+			return
+		}
+		err = writer.Close()
+		if err != nil {
+			_ = pw.CloseWithError(errors.Wrap(err, "failed to close multipart writer"))
+			return
+		}
+		_ = pw.Close()
+	}()
+	return pr, writer.FormDataContentType()
+}
+
 func randRouteHint() string {
 	charset := "abcdef0123456789"
 	b := make([]byte, 16)
@@ -4,10 +4,15 @@ import (
 	"context"
 	"database/sql/driver"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMakeHeadersUserPassword(t *testing.T) {
@@ -33,7 +38,7 @@ func TestMakeHeadersAccessToken(t *testing.T) {
 		accessTokenLoader: NewStaticAccessTokenLoader("abc123"),
 		warehouse:         "small-abc",
 	}
-	ctx := checkQueryID(context.Background())
+	ctx := (&APIClient{}).checkQueryID(context.Background())
 	headers, err := c.makeHeaders(ctx)
 	assert.Nil(t, err)
 	assert.Equal(t, headers["Authorization"], []string{"Bearer abc123"})
@@ -45,14 +50,14 @@ func TestMakeHeadersAccessToken(t *testing.T) {
 func TestCheckQueryID(t *testing.T) {
 	// Test case 1: Context does not have ContextKeyQueryID
 	ctx := context.Background()
-	newCtx := checkQueryID(ctx)
+	newCtx := (&APIClient{}).checkQueryID(ctx)
 	_, ok := newCtx.Value(ContextKeyQueryID).(string)
 	assert.True(t, ok, "Expected ContextKeyQueryID to be present in the context")
 
 	// Test case 2: Context already has ContextKeyQueryID
 	queryID := uuid.NewString()
 	ctxWithQueryID := context.WithValue(ctx, ContextKeyQueryID, queryID)
-	newCtxWithQueryID := checkQueryID(ctxWithQueryID)
+	newCtxWithQueryID := (&APIClient{}).checkQueryID(ctxWithQueryID)
 	assert.Equal(t, queryID, newCtxWithQueryID.Value(ContextKeyQueryID), "Expected ContextKeyQueryID to remain unchanged in the context")
 }
 
@@ -71,6 +76,25 @@ func TestMakeHeadersQueryID(t *testing.T) {
 	assert.Equal(t, headers["X-Databend-Query-Id"], []string{queryId})
 }
 
+func TestMakeHeadersCallerQueryID(t *testing.T) {
+	c := APIClient{user: "root", password: "root"}
+	for _, queryID := range []string{"svc:req/42", "tenant#1 job@host"} {
+		ctx := context.WithValue(context.Background(), ContextKeyQueryID, queryID)
+		headers, err := c.makeHeaders(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, queryID, headers.Get(DatabendQueryIDHeader))
+	}
+
+	ctx := context.WithValue(context.Background(), ContextKeyQueryID, "req\r\nX-Injected: 1")
+	_, err := c.makeHeaders(ctx)
+	assert.ErrorContains(t, err, "invalid query id")
+
+	// the generated ids are still checked strictly
+	c.queryIDGenerator = func() string { return "req:1" }
+	_, err = c.makeHeaders(c.checkQueryID(context.Background()))
+	assert.ErrorContains(t, err, "invalid query id")
+}
+
 func TestDoQuery(t *testing.T) {
 	var result QueryResponse
 	result.ID = "mockid1"
@@ -101,3 +125,113 @@ func TestDoQuery(t *testing.T) {
 	assert.Equal(t, gotQueryID, "mockid1")
 	assert.Equal(t, resp.ID, queryId)
 }
+
+func TestDeduplicateLabelNotKeptInSession(t *testing.T) {
+	var gotSession map[string]interface{}
+	mockDoRequest := func(method, path string, req interface{}, resp interface{}) error {
+		request := req.(*QueryRequest)
+		_ = json.Unmarshal(*request.Session, &gotSession)
+		// the server echoes the session with the settings of the request
+		result := QueryResponse{ID: "q1", State: "Succeeded", Session: request.Session}
+		buf, _ := json.Marshal(result)
+		return json.Unmarshal(buf, resp)
+	}
+	c := NewAPIClientFromConfig(&Config{
+		User:     "root",
+		Database: "db1",
+		Params:   map[string]string{"max_threads": "4"},
+	})
+	c.doRequestFunc = mockDoRequest
+
+	ctx := context.WithValue(context.Background(), ContextKeyDeduplicateLabel, "label-1")
+	_, err := c.StartQuery(ctx, "INSERT INTO t VALUES (1)", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"max_threads": "4", DEDUPLICATE_LABEL: "label-1"}, gotSession["settings"])
+	assert.Equal(t, "db1", gotSession["database"])
+
+	assert.Equal(t, map[string]string{"max_threads": "4"}, c.getSessionState().Settings)
+	assert.NotContains(t, string(*c.getSessionStateRaw()), "label-1")
+
+	_, err = c.StartQuery(context.Background(), "INSERT INTO t VALUES (1)", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"max_threads": "4"}, gotSession["settings"])
+}
+
+func TestQueryTimeoutFromDeadline(t *testing.T) {
+	var gotSession map[string]interface{}
+	c := NewAPIClientFromConfig(&Config{User: "root"})
+	c.doRequestFunc = func(method, path string, req interface{}, resp interface{}) error {
+		gotSession = nil
+		_ = json.Unmarshal(*req.(*QueryRequest).Session, &gotSession)
+		return json.Unmarshal([]byte(`{"id":"q1","state":"Succeeded"}`), resp)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
+	defer cancel()
+	_, err := c.StartQuery(ctx, "SELECT 1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{MAX_EXECUTE_TIME_IN_SECONDS: "90"}, gotSession["settings"])
+
+	_, err = c.StartQuery(context.Background(), "SELECT 1", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, gotSession["settings"])
+}
+
+// runningQuery is the response of a query still running, its pages block until the
+// request is canceled.
+const runningQuery = `{"id":"q1","state":"Running","next_uri":"/v1/query/q1/page/1",
+"kill_uri":"/v1/query/q1/kill","final_uri":"/v1/query/q1/final",
+"schema":[{"name":"n","type":"Int64"}],"data":[["1"]]}`
+
+func blockPages(r *http.Request) string {
+	if strings.HasSuffix(r.URL.Path, "/page/1") {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return `{"id":"q1","state":"Succeeded"}`
+}
+
+func TestQuerySyncKilledOnDeadline(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string { return runningQuery }
+	srv.onPage = blockPages
+
+	dc := newTestConn(t, srv.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := dc.rest.QuerySync(ctx, "SELECT * FROM numbers(100000000)", nil)
+	assert.Error(t, err)
+	assert.Contains(t, srv.requestedPages(), "/v1/query/q1/kill")
+}
+
+func TestQueryIDGenerator(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string { return runningQuery }
+	var ids []string
+	srv.onPage = func(r *http.Request) string {
+		ids = append(ids, r.Header.Get(DatabendQueryIDHeader))
+		return `{"id":"q1","state":"Succeeded"}`
+	}
+
+	dc := newTestConn(t, srv.URL)
+	seq := 0
+	dc.rest.queryIDGenerator = func() string {
+		seq++
+		return fmt.Sprintf("req-%d", seq)
+	}
+	dc.rest.queryIDPrefix = "svc."
+	_, err := dc.exec(context.Background(), "SELECT 1")
+	require.NoError(t, err)
+	_, err = dc.exec(context.Background(), "SELECT 2")
+	require.NoError(t, err)
+	// the pages and the final of a query carry the id it's started with
+	assert.Equal(t, []string{"svc.req-1", "svc.req-1", "svc.req-2", "svc.req-2"}, ids)
+
+	dc.rest.queryIDGenerator = func() string { return "req 3" }
+	_, err = dc.exec(context.Background(), "SELECT 3")
+	assert.ErrorContains(t, err, "invalid query id")
+}
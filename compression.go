@@ -0,0 +1,114 @@
+package godatabend
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// parseUploadCompression parses the compression of the uploaded files, only gzip and
+// zstd are supported by the client, none disables the compression.
+func parseUploadCompression(v string) (Compression, error) {
+	switch c := Compression(strings.ToLower(v)); c {
+	case "", CompressionNone:
+		return "", nil
+	case CompressionGzip, CompressionZstd:
+		return c, nil
+	}
+	return "", errors.Errorf("unsupported upload compression %q, expect gzip, zstd or none", v)
+}
+
+// newCompressWriter returns a writer compressing the data into w, it must be closed to
+// flush the compressed data.
+func newCompressWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, errors.Errorf("unsupported upload compression %q", string(c))
+}
+
+// compressionExt is the file extension of the compression, so the compressed files in
+// the stage are recognized by their names.
+func compressionExt(c Compression) string {
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// compressible reports whether the files of the format could be compressed as a whole,
+// the columnar formats are compressed inside the files.
+func compressible(fileFormatOptions map[string]string) bool {
+	switch strings.ToUpper(fileFormatOptions["type"]) {
+	case "PARQUET", "ORC":
+		return false
+	}
+	return true
+}
+
+// withUploadCompression returns the file format options with the compression of the
+// uploaded files, the options are not changed if the compression is set already.
+func (c *APIClient) withUploadCompression(fileFormatOptions map[string]string) map[string]string {
+	if c.UploadCompression == "" || !compressible(fileFormatOptions) {
+		return fileFormatOptions
+	}
+	if _, ok := fileFormatOptions["compression"]; ok {
+		return fileFormatOptions
+	}
+	options := make(map[string]string, len(fileFormatOptions)+1)
+	for k, v := range fileFormatOptions {
+		options[k] = v
+	}
+	options["compression"] = strings.ToUpper(string(c.UploadCompression))
+	return options
+}
+
+// uploadCompressed compresses the input by UploadCompression and uploads it to the stage.
+// The upload api takes the data compressed on the fly, while a presigned url needs the
+// size of the data, so it's compressed into a buffer first, spilled into tempDir.
+func (c *APIClient) uploadCompressed(ctx context.Context, stage *StageLocation, input io.Reader, tempDir string) error {
+	if c.PresignedURLDisabled {
+		return c.uploadToStageByAPI(ctx, stage, input, c.UploadCompression)
+	}
+	buf, err := c.compressToBuffer(input, tempDir)
+	if err != nil {
+		return err
+	}
+	defer buf.Close()
+	presigned, err := c.GetPresignedURL(ctx, stage)
+	if err != nil {
+		return errors.Wrap(err, "failed to get presigned url")
+	}
+	return c.uploadWithRetry(ctx, stage, presigned, func() (io.Reader, int64, error) {
+		r, err := buf.Reader()
+		return r, buf.Size(), err
+	})
+}
+
+// compressToBuffer compresses the input into a buffer, so the compressed size is known
+// before it's uploaded. The buffer must be closed by the caller.
+func (c *APIClient) compressToBuffer(input io.Reader, tempDir string) (*batchBuffer, error) {
+	buf := newBatchBuffer(0, tempDir)
+	zw, err := newCompressWriter(buf, c.UploadCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(zw, input); err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		_ = buf.Close()
+		return nil, errors.Wrap(err, "compress upload data failed")
+	}
+	return buf, nil
+}
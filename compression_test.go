@@ -0,0 +1,96 @@
+package godatabend
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUploadCompression(t *testing.T) {
+	c, err := parseUploadCompression("GZIP")
+	require.NoError(t, err)
+	assert.Equal(t, CompressionGzip, c)
+	c, err = parseUploadCompression("none")
+	require.NoError(t, err)
+	assert.Equal(t, Compression(""), c)
+	_, err = parseUploadCompression("bz2")
+	assert.Error(t, err)
+}
+
+func TestBatchInsertCompressed(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	dc.rest.UploadCompression = CompressionGzip
+	b, err := dc.prepareBatch(context.Background(), "INSERT INTO t VALUES")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.AppendToFile([]driver.Value{i, "a"}))
+	}
+	require.NoError(t, b.BatchInsert())
+
+	batch := b.(*httpBatch)
+	data, ok := srv.uploads[batch.stage.Path+"part-00001.csv.gz"]
+	require.True(t, ok)
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	content, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, "0,a\n1,a\n2,a\n", string(content))
+
+	require.Len(t, srv.queries, 1)
+	assert.Equal(t, "GZIP", srv.queries[0].StageAttachment.FileFormatOptions["compression"])
+}
+
+func TestLoadReaderCompressed(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		return copyResultResponse
+	}
+
+	dc := newTestConn(t, srv.URL)
+	dc.rest.UploadCompression = CompressionZstd
+	content := strings.Repeat("1,abcdefg\n", 1000)
+	result, err := dc.LoadReader(context.Background(), "t", strings.NewReader(content), BatchFormatCSV, nil)
+	require.NoError(t, err)
+
+	data := srv.uploads[result.Stage.Path+"data.csv.zst"]
+	assert.True(t, len(data) < len(content))
+	zr, err := zstd.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	defer zr.Close()
+	decoded, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(decoded))
+	require.Len(t, srv.queries, 1)
+	assert.Contains(t, srv.queries[0].SQL, "compression = 'ZSTD'")
+}
+
+func TestUploadToStageNotCompressed(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	dc.rest.UploadCompression = CompressionZstd
+	// the data of the caller is uploaded and loaded as it is
+	stage := &StageLocation{Name: "~", Path: "upload/data.csv"}
+	content := "1,abcdefg\n"
+	require.NoError(t, dc.rest.UploadToStage(context.Background(), stage, bufio.NewReader(strings.NewReader(content)), int64(len(content))))
+	assert.Equal(t, content, string(srv.uploads[stage.Path]))
+
+	_, err := dc.rest.InsertWithStage(context.Background(), "INSERT INTO t VALUES", stage, nil, nil)
+	require.NoError(t, err)
+	require.Len(t, srv.queries, 1)
+	assert.NotContains(t, srv.queries[0].StageAttachment.FileFormatOptions, "compression")
+}
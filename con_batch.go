@@ -1,14 +1,16 @@
 package godatabend
 
 import (
-	"bufio"
 	"context"
+	"crypto/sha256"
 	"database/sql/driver"
-	"encoding/csv"
 	"fmt"
+	"hash"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -23,93 +25,366 @@ type Batch interface {
 	BatchInsert() error
 }
 
+// BatchProgress describes the progress of a batch insert.
+type BatchProgress struct {
+	RowsAppended  int64
+	FilesCut      int64
+	FilesUploaded int64
+	BytesUploaded int64
+	// Done is set on the last report, after the rows have been inserted into the table.
+	Done bool
+}
+
+// BatchProgressTracker is a function that will be called when a stage file of a batch
+// insert has been uploaded and when the batch insert finishes, it can be specified in
+// the Config struct. The calls of one batch are never concurrent.
+type BatchProgressTracker func(progress BatchProgress)
+
 func (dc *DatabendConn) prepareBatch(ctx context.Context, query string) (Batch, error) {
 	matches := httpInsertRe.FindStringSubmatch(query)
 	if len(matches) < 2 {
 		return nil, errors.New("cannot get table name from query")
 	}
-	csvFileName := fmt.Sprintf("%s/%s.csv", os.TempDir(), uuid.NewString())
 
-	csvFile, err := os.OpenFile(csvFileName, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
+	cfg := dc.cfg
+	if cfg == nil {
+		cfg = NewConfig()
+	}
+	format, err := batchFormatFromContext(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
-	defer csvFile.Close()
-	writer := csv.NewWriter(csvFile)
-	writer.Flush()
+	// the formats other than CSV are encoded by the column names and types
+	var columns []batchColumn
+	if format != BatchFormatCSV {
+		columns, err = dc.describeBatchColumns(ctx, matches[1], matches[2])
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return &httpBatch{
-		query:     query,
-		ctx:       ctx,
-		conn:      dc,
-		batchFile: csvFileName,
-	}, nil
+	batchID := uuid.NewString()
+	b := &httpBatch{
+		query:   query,
+		ctx:     ctx,
+		conn:    dc,
+		cfg:     cfg,
+		format:  format,
+		columns: columns,
+		stage: &StageLocation{
+			Name: "~",
+			Path: fmt.Sprintf("batch/%d-%s/", time.Now().Unix(), batchID),
+		},
+		fileFormatOptions: dc.rest.withUploadCompression(dc.rest.batchFormatOptions(format)),
+		pool:              newUploadPool(dc.rest, cfg.BatchUploadWorkers),
+	}
+	if format != BatchFormatParquet {
+		b.compression = dc.rest.UploadCompression
+	}
+	if label, ok := ctx.Value(ContextKeyDeduplicateLabel).(string); ok && label != "" {
+		b.label = label
+	} else if cfg.BatchDeduplicate {
+		b.hash = sha256.New()
+		b.hash.Write([]byte(query))
+	}
+	if cfg.BatchSpoolDir != "" {
+		b.spool = &spoolManifest{
+			ID:                batchID,
+			SQL:               query,
+			Format:            format,
+			FileFormatOptions: b.fileFormatOptions,
+			StageName:         b.stage.Name,
+			StagePath:         b.stage.Path,
+			DeduplicateLabel:  b.label,
+			State:             spoolStateAppending,
+			CreatedAt:         time.Now(),
+			dir:               filepath.Join(cfg.BatchSpoolDir, batchID),
+		}
+		b.spool.own()
+		if err = os.MkdirAll(b.spool.dir, 0755); err != nil {
+			b.spool.release()
+			return nil, errors.Wrap(err, "create batch spool dir failed")
+		}
+		if err = b.spool.save(); err != nil {
+			b.spool.release()
+			return nil, err
+		}
+	}
+	if err = b.newFile(); err != nil {
+		b.discard()
+		return nil, err
+	}
+	return b, nil
 }
 
 type httpBatch struct {
-	query     string
-	ctx       context.Context
-	conn      *DatabendConn
-	batchFile string
-	err       error
+	query string
+	ctx   context.Context
+	conn  *DatabendConn
+	cfg   *Config
+	// stage is the directory holding all the files of the batch
+	stage             *StageLocation
+	format            BatchFormat
+	columns           []batchColumn
+	fileFormatOptions map[string]string
+	// compression of the files, the rows are compressed as they are encoded
+	compression Compression
+	// spool is set if the batch is spooled in Config.BatchSpoolDir
+	spool *spoolManifest
+	// ended is set once the batch is inserted or discarded
+	ended bool
+	// label is the deduplicate label of the insert, it's supplied by the caller or
+	// derived from the hash of the query and the batch files
+	label string
+	hash  hash.Hash
+
+	// the file currently being written
+	fileSeq  int
+	fileName string
+	buf      *batchBuffer
+	zw       io.WriteCloser
+	enc      batchEncoder
+	rows     int64
+
+	pool *uploadPool
+
+	mu       sync.Mutex
+	progress BatchProgress
+	// serializes the progress tracker calls
+	trackMu sync.Mutex
 }
 
-func (b *httpBatch) BatchInsert() error {
-	defer func() {
-		err := os.RemoveAll(b.batchFile)
+func (b *httpBatch) newFile() error {
+	b.fileSeq++
+	b.fileName = fmt.Sprintf("part-%05d.%s%s", b.fileSeq, b.format, compressionExt(b.compression))
+	if b.spool != nil {
+		buf, err := newSpoolBatchBuffer(filepath.Join(b.spool.dir, b.fileName))
 		if err != nil {
-			b.conn.log("delete batch insert file failed: ", err)
+			return err
 		}
-	}()
-	stage, err := b.UploadToStage(context.Background())
+		b.buf = buf
+	} else {
+		b.buf = newBatchBuffer(b.cfg.BatchBufferSize, b.cfg.BatchTempDir)
+	}
+	var w io.Writer = b.buf
+	b.zw = nil
+	if b.compression != "" {
+		zw, err := newCompressWriter(b.buf, b.compression)
+		if err != nil {
+			return err
+		}
+		b.zw = zw
+		w = zw
+	}
+	// the label is derived from the data before compression
+	if b.hash != nil {
+		w = io.MultiWriter(w, b.hash)
+	}
+	enc, err := newBatchEncoder(b.format, w, b.columns)
 	if err != nil {
+		return err
+	}
+	b.enc = enc
+	b.rows = 0
+	return nil
+}
+
+func (b *httpBatch) BatchInsert() (err error) {
+	// inserting is set once the insert may have been sent
+	inserting := false
+	b.ended = true
+	defer func() {
+		if b.buf != nil {
+			if err := b.buf.Close(); err != nil {
+				b.conn.log("delete batch insert file failed: ", err)
+			}
+		}
+		if b.spool != nil {
+			_ = b.pool.wait()
+			b.endSpool(err, inserting)
+		}
+	}()
+	// the last file is always uploaded, even if it's empty, so the stage directory exists
+	if b.rows > 0 || b.progress.FilesCut == 0 {
+		if err := b.cutFile(); err != nil {
+			return err
+		}
+	}
+	if b.hash != nil {
+		b.label = fmt.Sprintf("batch-%x", b.hash.Sum(nil))
+	}
+	if b.spool != nil && b.label == "" {
+		// the recovery may insert a batch already inserted by the crashed process
+		b.label = spoolDeduplicateLabel(b.spool.ID)
+	}
+	if b.spool != nil {
+		b.spool.DeduplicateLabel = b.label
+		b.spool.State = spoolStateCommitting
+		b.spool.Attempts++
+		if err := b.spool.save(); err != nil {
+			return err
+		}
+	}
+	if err := b.pool.wait(); err != nil {
 		return errors.Wrap(err, "upload to stage failed")
 	}
-	_, err = b.conn.rest.InsertWithStage(b.ctx, b.query, stage, nil, nil)
+
+	// all the files are inserted within one statement, so the batch is applied atomically
+	ctx := b.ctx
+	if b.label != "" {
+		ctx = context.WithValue(ctx, ContextKeyDeduplicateLabel, b.label)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	inserting = true
+	_, err = b.conn.rest.InsertWithStage(ctx, b.query, b.stage, b.fileFormatOptions, nil)
 	if err != nil {
 		return errors.Wrap(err, "insert with stage failed")
 	}
+	b.mu.Lock()
+	b.progress.Done = true
+	b.mu.Unlock()
+	b.trackProgress()
 	return nil
 }
 
-func (b *httpBatch) AppendToFile(v []driver.Value) error {
-	csvFile, err := os.OpenFile(b.batchFile, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
-	if err != nil {
-		return err
+// endSpool ends the spool of the batch failed with err, or inserted if err is nil. The
+// rows inserted in a transaction are only durable once it's committed, so the spool is
+// handed over to the transaction, which removes it when it ends. A failed batch is kept
+// in the committing state only if its insert may have been applied, so it's inserted
+// again under its label by RecoverSpool, the caller was told the other ones failed.
+func (b *httpBatch) endSpool(err error, inserting bool) {
+	tx := b.conn.tx
+	switch {
+	case err == nil && tx != nil:
+		tx.spools = append(tx.spools, b.spool)
+		return
+	// the failed insert of a transaction is rolled back along with it
+	case err != nil && inserting && tx == nil && mayBeApplied(b.ctx, err):
+		b.spool.release()
+		return
+	}
+	if err := b.spool.remove(); err != nil {
+		b.conn.log("delete batch spool dir failed: ", err)
 	}
-	defer csvFile.Close()
+}
 
-	lineData := make([]string, 0, len(v))
-	for i := range v {
-		lineData = append(lineData, fmt.Sprintf("%v", v[i]))
+// discard drops the batch never inserted, such as its transaction is rolled back, its
+// spool is removed so it's not inserted by RecoverSpool.
+func (b *httpBatch) discard() {
+	if b.ended {
+		return
 	}
-	writer := csv.NewWriter(csvFile)
-	err = writer.Write(lineData)
-	if err != nil {
+	b.ended = true
+	if b.buf != nil {
+		_ = b.buf.Close()
+	}
+	_ = b.pool.wait()
+	if b.spool != nil {
+		if err := b.spool.remove(); err != nil {
+			b.conn.log("delete batch spool dir failed: ", err)
+		}
+	}
+}
+
+func (b *httpBatch) AppendToFile(v []driver.Value) error {
+	if err := b.uploadErr(); err != nil {
+		return errors.Wrap(err, "upload to stage failed")
+	}
+	if err := b.enc.Encode(v); err != nil {
 		return err
 	}
-	writer.Flush()
+	b.rows++
+	b.mu.Lock()
+	b.progress.RowsAppended++
+	b.mu.Unlock()
 
+	if b.cfg.BatchMaxRows > 0 && b.rows >= b.cfg.BatchMaxRows {
+		return b.cutFile()
+	}
+	if b.cfg.BatchMaxBytes > 0 && b.buf.Size()+b.enc.Buffered() >= b.cfg.BatchMaxBytes {
+		return b.cutFile()
+	}
 	return nil
 }
 
-func (b *httpBatch) UploadToStage(ctx context.Context) (*StageLocation, error) {
-	ctx = checkQueryID(ctx)
-	fi, err := os.Stat(b.batchFile)
-	if err != nil {
-		return nil, errors.Wrap(err, "get batch file size failed")
+// cutFile finishes the current file and hands it over to the upload workers, it blocks
+// while all the workers are busy, so the appending is throttled by the uploading.
+func (b *httpBatch) cutFile() error {
+	if err := b.enc.Close(); err != nil {
+		return errors.Wrap(err, "flush batch data failed")
 	}
-	size := fi.Size()
+	if b.zw != nil {
+		if err := b.zw.Close(); err != nil {
+			return errors.Wrap(err, "compress batch data failed")
+		}
+	}
+	buf := b.buf
+	b.buf = nil
+	if b.spool != nil {
+		if err := buf.Sync(); err != nil {
+			_ = buf.Close()
+			return errors.Wrap(err, "sync batch spool file failed")
+		}
+		b.spool.Files = append(b.spool.Files, b.fileName)
+		if err := b.spool.save(); err != nil {
+			_ = buf.Close()
+			return err
+		}
+	}
+	stage := &StageLocation{
+		Name: b.stage.Name,
+		Path: b.stage.Path + b.fileName,
+	}
+
+	b.mu.Lock()
+	b.progress.FilesCut++
+	b.mu.Unlock()
 
-	f, err := os.Open(b.batchFile)
+	err := b.pool.upload(b.conn.rest.checkQueryID(b.ctx), stage, func(presigned *PresignedResponse) error {
+		defer buf.Close()
+		if err := b.uploadFile(buf, stage, presigned); err != nil {
+			return err
+		}
+		b.mu.Lock()
+		b.progress.FilesUploaded++
+		b.progress.BytesUploaded += buf.Size()
+		b.mu.Unlock()
+		b.trackProgress()
+		return nil
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "open batch file failed")
+		_ = buf.Close()
+		return err
 	}
-	defer f.Close()
-	input := bufio.NewReader(f)
-	stage := &StageLocation{
-		Name: "~",
-		Path: fmt.Sprintf("batch/%d-%s", time.Now().Unix(), filepath.Base(b.batchFile)),
+
+	return b.newFile()
+}
+
+func (b *httpBatch) uploadFile(buf *batchBuffer, stage *StageLocation, presigned *PresignedResponse) error {
+	ctx := b.conn.rest.checkQueryID(b.ctx)
+	return b.conn.rest.uploadWithRetry(ctx, stage, presigned, func() (io.Reader, int64, error) {
+		input, err := buf.Reader()
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "read batch data failed")
+		}
+		return input, buf.Size(), nil
+	})
+}
+
+func (b *httpBatch) uploadErr() error {
+	return b.pool.uploadErr()
+}
+
+func (b *httpBatch) trackProgress() {
+	if b.cfg.BatchProgressTracker == nil {
+		return
 	}
-	return stage, b.conn.rest.UploadToStage(ctx, stage, input, size)
+	b.trackMu.Lock()
+	defer b.trackMu.Unlock()
+	b.mu.Lock()
+	progress := b.progress
+	b.mu.Unlock()
+	b.cfg.BatchProgressTracker(progress)
 }
@@ -0,0 +1,283 @@
+package godatabend
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	uploads map[string][]byte
+	queries []QueryRequest
+	// onQuery returns the response body of a query, a succeeded empty result by default
+	onQuery func(req QueryRequest) string
+	// failUploads is the number of the next uploads responded with 503
+	failUploads int
+	// pages are the paths of the requests following a query, like the next, kill and final uris
+	pages []string
+	// onPage returns the response body of a request following a query, a succeeded empty
+	// result by default
+	onPage func(r *http.Request) string
+}
+
+// newTestServer fakes the upload_to_stage and query APIs, the uploaded files are
+// kept by their full stage path and every query succeeds at once.
+func newTestServer(t testing.TB) *testServer {
+	s := &testServer{uploads: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/upload_to_stage":
+			s.mu.Lock()
+			fail := s.failUploads > 0
+			s.failUploads--
+			s.mu.Unlock()
+			if fail {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if err := s.handleUpload(r); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case "/v1/query":
+			var req QueryRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			s.mu.Lock()
+			s.queries = append(s.queries, req)
+			s.mu.Unlock()
+			body := `{"id":"q1","state":"Succeeded"}`
+			if s.onQuery != nil {
+				body = s.onQuery(req)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(body))
+		default:
+			if !strings.HasPrefix(r.URL.Path, "/v1/query/") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			s.mu.Lock()
+			s.pages = append(s.pages, r.URL.Path)
+			s.mu.Unlock()
+			body := `{"id":"q1","state":"Succeeded"}`
+			if s.onPage != nil {
+				body = s.onPage(r)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(body))
+		}
+	}))
+	return s
+}
+
+func (s *testServer) requestedPages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.pages...)
+}
+
+func (s *testServer) handleUpload(r *http.Request) error {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.uploads[params["filename"]] = data
+		s.mu.Unlock()
+	}
+}
+
+func newTestConn(t testing.TB, host string) *DatabendConn {
+	cfg := NewConfig()
+	cfg.Host = strings.TrimPrefix(host, "http://")
+	cfg.SSLMode = SSL_MODE_DISABLE
+	cfg.User = "root"
+	cfg.PresignedURLDisabled = true
+	cfg.BatchTempDir = t.TempDir()
+	dc, err := buildDatabendConn(context.Background(), *cfg)
+	require.NoError(t, err)
+	return dc
+}
+
+// openTestDB opens a database of the test server through the registered driver.
+func openTestDB(t testing.TB, host string) *sql.DB {
+	dsn := fmt.Sprintf("http://root:@%s/?presigned_url_disabled=1", strings.TrimPrefix(host, "http://"))
+	db, err := sql.Open("databend", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestBatchBufferSpill(t *testing.T) {
+	buf := newBatchBuffer(16, t.TempDir())
+
+	_, err := buf.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	assert.False(t, buf.Spilled())
+
+	_, err = buf.Write([]byte("abcdefghij"))
+	require.NoError(t, err)
+	assert.True(t, buf.Spilled())
+	assert.Equal(t, int64(20), buf.Size())
+
+	r, err := buf.Reader()
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789abcdefghij", string(data))
+
+	name := buf.file.Name()
+	require.NoError(t, buf.Close())
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBatchInsertCutFiles(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	var progress []BatchProgress
+	dc := newTestConn(t, srv.URL)
+	dc.cfg.BatchBufferSize = 16
+	dc.cfg.BatchMaxRows = 3
+	dc.cfg.BatchUploadWorkers = 2
+	dc.cfg.BatchProgressTracker = func(p BatchProgress) {
+		progress = append(progress, p)
+	}
+	b, err := dc.prepareBatch(context.Background(), "INSERT INTO t VALUES")
+	require.NoError(t, err)
+	batch := b.(*httpBatch)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, batch.AppendToFile([]driver.Value{i, fmt.Sprintf("name,%d", i)}))
+	}
+	require.NoError(t, batch.BatchInsert())
+
+	require.Len(t, srv.uploads, 4)
+	var lines []string
+	for i := 1; i <= 4; i++ {
+		data, ok := srv.uploads[fmt.Sprintf("%spart-%05d.csv", batch.stage.Path, i)]
+		require.True(t, ok)
+		lines = append(lines, strings.Split(strings.TrimSpace(string(data)), "\n")...)
+	}
+	assert.Len(t, lines, 10)
+	assert.Contains(t, lines, `9,"name,9"`)
+
+	require.Len(t, srv.queries, 1)
+	assert.Equal(t, "INSERT INTO t VALUES", srv.queries[0].SQL)
+	assert.Equal(t, batch.stage.String(), srv.queries[0].StageAttachment.Location)
+	assert.True(t, strings.HasSuffix(srv.queries[0].StageAttachment.Location, "/"))
+
+	require.Len(t, progress, 5)
+	assert.Equal(t, BatchProgress{RowsAppended: 10, FilesCut: 4, FilesUploaded: 4, BytesUploaded: progress[4].BytesUploaded, Done: true}, progress[4])
+}
+
+func TestBatchInsertCanceled(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	b, err := dc.prepareBatch(ctx, "INSERT INTO t VALUES")
+	require.NoError(t, err)
+	batch := b.(*httpBatch)
+	require.NoError(t, batch.AppendToFile([]driver.Value{1, "a"}))
+
+	// the uploads are canceled along with the batch
+	cancel()
+	err = batch.BatchInsert()
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.Canceled), err.Error())
+	assert.Empty(t, srv.uploads)
+	assert.Empty(t, srv.queries)
+}
+
+func BenchmarkBatchAppend(b *testing.B) {
+	dc := newTestConn(b, "localhost:8000")
+	batch, err := dc.prepareBatch(context.Background(), "INSERT INTO t VALUES")
+	require.NoError(b, err)
+	defer batch.(*httpBatch).buf.Close()
+
+	row := []driver.Value{int64(1234), "2345", 3.1415, "test", "test2", "[4, 5, 6]", "2021-01-01 00:00:00"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if err := batch.AppendToFile(row); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "rows/s")
+}
+
+func BenchmarkBatchUploadByAPI(b *testing.B) {
+	const rows = 1000000
+	srv := newTestServer(b)
+	defer srv.Close()
+
+	dc := newTestConn(b, srv.URL)
+	batch, err := dc.prepareBatch(context.Background(), "INSERT INTO t VALUES")
+	require.NoError(b, err)
+	hb := batch.(*httpBatch)
+	defer hb.buf.Close()
+
+	row := []driver.Value{int64(1234), "2345", 3.1415, "test", "test2", "[4, 5, 6]", "2021-01-01 00:00:00"}
+	for i := 0; i < rows; i++ {
+		require.NoError(b, batch.AppendToFile(row))
+	}
+	require.NoError(b, hb.enc.Close())
+	stage := &StageLocation{Name: "~", Path: "batch/bench.csv"}
+
+	b.SetBytes(hb.buf.Size())
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		input, err := hb.buf.Reader()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := dc.rest.UploadToStageByAPI(context.Background(), stage, bufio.NewReader(input)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(rows*b.N)/time.Since(start).Seconds(), "rows/s")
+}
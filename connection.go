@@ -7,8 +7,7 @@ import (
 	"log"
 	"os"
 	"sync/atomic"
-
-	"github.com/google/uuid"
+	"time"
 )
 
 const (
@@ -27,19 +26,28 @@ type DatabendConn struct {
 	rest        *APIClient
 	batchMode   bool
 	batchInsert func() error
+	// batchDiscard drops the prepared batch if it's not inserted
+	batchDiscard func()
+	// settingTypes are the types of the settings of the server by name, loaded by Settings.
+	settingTypes map[string]string
+	// tx is the transaction started by BeginTx and not ended yet.
+	tx *databendTx
 }
 
 func (dc *DatabendConn) exec(ctx context.Context, query string, args ...driver.Value) (driver.Result, error) {
-	ctx = checkQueryID(ctx)
-	_, err := dc.rest.QuerySync(ctx, query, args)
+	ctx = dc.rest.checkQueryID(ctx)
+	result := &execResult{queryInfo: queryInfo{start: time.Now()}}
+	resp, err := dc.rest.QuerySync(ctx, query, args)
 	if err != nil {
 		return emptyResult, err
 	}
-	return emptyResult, nil
+	result.track(resp)
+	return result, nil
 }
 
 func (dc *DatabendConn) query(ctx context.Context, query string, args ...driver.Value) (rows driver.Rows, err error) {
-	ctx = checkQueryID(ctx)
+	ctx = dc.rest.checkQueryID(ctx)
+	start := time.Now()
 	r0, err := dc.rest.StartQuery(ctx, query, args)
 	if err != nil {
 		return nil, fmt.Errorf("query failed: %w", err)
@@ -51,33 +59,28 @@ func (dc *DatabendConn) query(ctx context.Context, query string, args ...driver.
 	}()
 
 	if r0.Error != nil {
-		return nil, fmt.Errorf("query error: %+v", r0.Error)
+		return nil, fmt.Errorf("query error: %w", r0.Error)
 	}
 	response, err := waitForData(ctx, dc, r0)
 	if err != nil {
 		return nil, err
 	}
-	return newNextRows(ctx, dc, response)
+	r, err := newNextRows(ctx, dc, response)
+	if err != nil {
+		return nil, err
+	}
+	r.queryInfo.start = start
+	r.track(r0)
+	r.track(response)
+	return r, nil
 }
 
 func (dc *DatabendConn) Begin() (driver.Tx, error) {
 	return dc.BeginTx(dc.ctx, driver.TxOptions{})
 }
 
-func (dc *DatabendConn) BeginTx(
-	ctx context.Context,
-	_ driver.TxOptions) (
-	driver.Tx, error) {
-	if dc.rest == nil {
-		return nil, driver.ErrBadConn
-	}
-	if _, err := dc.exec(ctx, "BEGIN"); err != nil {
-		return nil, err
-	}
-	return &databendTx{dc}, nil
-}
-
 func (dc *DatabendConn) cleanup() {
+	dc.discardBatch()
 	// must flush log buffer while the process is running.
 	dc.rest = nil
 	dc.cfg = nil
@@ -104,7 +107,9 @@ func (dc *DatabendConn) prepare(ctx context.Context, query string) (*databendStm
 	if err != nil {
 		return nil, err
 	}
+	dc.discardBatch()
 	dc.batchInsert = batch.BatchInsert
+	dc.batchDiscard = batch.(*httpBatch).discard
 	dc.batchMode = true
 	stmt := &databendStmt{
 		dc:    dc,
@@ -115,7 +120,10 @@ func (dc *DatabendConn) prepare(ctx context.Context, query string) (*databendStm
 }
 
 func (dc *DatabendConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
-	ctx = checkQueryID(ctx)
+	if err := dc.checkTxStatements(query); err != nil {
+		return nil, err
+	}
+	ctx = dc.rest.checkQueryID(ctx)
 	return dc.prepare(ctx, query)
 }
 
@@ -154,19 +162,88 @@ func (dc *DatabendConn) Close() error {
 	return nil
 }
 
-func (dc *DatabendConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+// IsValid implements driver.Validator, the connection is discarded by the pool if it's
+// left in a transaction, or a query request failed after all the retries.
+func (dc *DatabendConn) IsValid() bool {
+	if atomic.LoadInt32(&dc.closed) == 1 || dc.rest == nil {
+		return false
+	}
+	return !dc.rest.broken && !dc.rest.inActiveTransaction()
+}
+
+// ResetSession implements driver.SessionResetter, it resets the session to the
+// database, the role and the settings of the DSN before the connection is reused, so
+// the USE and SET statements of the previous user are not kept.
+func (dc *DatabendConn) ResetSession(ctx context.Context) error {
+	if !dc.IsValid() {
+		return driver.ErrBadConn
+	}
+	dc.rest.resetSession()
+	dc.tx = nil
+	dc.batchMode = false
+	dc.discardBatch()
+	return nil
+}
+
+// discardBatch drops the batch prepared on the connection and not inserted, such as its
+// transaction is rolled back, so it's not inserted by RecoverSpool.
+func (dc *DatabendConn) discardBatch() {
+	if dc.batchDiscard != nil {
+		dc.batchDiscard()
+	}
+	dc.batchInsert = nil
+	dc.batchDiscard = nil
+}
+
+func (dc *DatabendConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (result driver.Result, err error) {
 	values := make([]driver.Value, len(args))
 	for i, arg := range args {
 		values[i] = arg.Value
 	}
+	defer func() {
+		dc.rollbackOnCancel(ctx, err)
+	}()
+	if dc.multiStatement(ctx) {
+		statements, err := scriptStatements(query, values)
+		if err != nil {
+			return emptyResult, err
+		}
+		if statements != nil {
+			if err := dc.checkTxStatements(statements...); err != nil {
+				return emptyResult, err
+			}
+			return dc.execScript(ctx, statements)
+		}
+	}
+	if err := dc.checkTxStatements(query); err != nil {
+		return emptyResult, err
+	}
 	return dc.exec(ctx, query, values...)
 }
 
-func (dc *DatabendConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+func (dc *DatabendConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (rows driver.Rows, err error) {
 	values := make([]driver.Value, len(args))
 	for i, arg := range args {
 		values[i] = arg.Value
 	}
+	defer func() {
+		dc.rollbackOnCancel(ctx, err)
+	}()
+	if dc.multiStatement(ctx) {
+		statements, err := scriptStatements(query, values)
+		if err != nil {
+			return nil, err
+		}
+		if statements != nil {
+			if err := dc.checkTxStatements(statements...); err != nil {
+				return nil, err
+			}
+			return dc.queryScript(ctx, statements)
+		}
+	}
+	if err := dc.checkTxStatements(query); err != nil {
+		return nil, err
+	}
 	return dc.query(ctx, query, values...)
 }
 
@@ -180,12 +257,3 @@ func (dc *DatabendConn) ExecuteBatch() (err error) {
 	}()
 	return dc.batchInsert()
 }
-
-// checkQueryID checks if query_id exists in context, if not, generate a new one
-func checkQueryID(ctx context.Context) context.Context {
-	if _, ok := ctx.Value(ContextKeyQueryID).(string); !ok {
-		queryId := uuid.NewString()
-		ctx = context.WithValue(ctx, ContextKeyQueryID, queryId)
-	}
-	return ctx
-}
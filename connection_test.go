@@ -0,0 +1,117 @@
+package godatabend
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoSession responds the session of the request with the changes of the statement.
+func echoSession(req QueryRequest) string {
+	session := map[string]interface{}{}
+	if req.Session != nil {
+		_ = json.Unmarshal(*req.Session, &session)
+	}
+	switch req.SQL {
+	case "USE db2":
+		session["database"] = "db2"
+	case "SET max_threads = 1":
+		session["settings"] = map[string]string{"max_threads": "1"}
+	case "SET ROLE r2":
+		session["role"] = "r2"
+	case "BEGIN":
+		session["txn_state"] = TxnStateActive
+	case "COMMIT", "ROLLBACK":
+		session["txn_state"] = TxnStateAutoCommit
+	}
+	buf, _ := json.Marshal(map[string]interface{}{"id": "q1", "state": "Succeeded", "session": session})
+	return string(buf)
+}
+
+func TestResetSessionInPool(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = echoSession
+	db := openTestDB(t, srv.URL)
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	for _, query := range []string{"USE db2", "SET max_threads = 1", "SET ROLE r2"} {
+		_, err := db.Exec(query)
+		require.NoError(t, err)
+	}
+	_, err := db.Exec("SELECT 1")
+	require.NoError(t, err)
+
+	require.Len(t, srv.queries, 4)
+	// every statement starts from the session of the DSN
+	for _, req := range srv.queries {
+		assert.Equal(t, `{}`, string(*req.Session), req.SQL)
+	}
+	assert.Equal(t, 1, db.Stats().OpenConnections)
+}
+
+func TestResetSessionKeptByConn(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = echoSession
+	db := openTestDB(t, srv.URL)
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, "USE db2")
+	require.NoError(t, err)
+	_, err = conn.ExecContext(ctx, "SELECT 1")
+	require.NoError(t, err)
+
+	require.Len(t, srv.queries, 2)
+	assert.Equal(t, `{"database":"db2"}`, string(*srv.queries[1].Session))
+}
+
+func TestConnWithOpenTransactionDiscarded(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = echoSession
+	db := openTestDB(t, srv.URL)
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	_, err := db.Exec("BEGIN")
+	require.NoError(t, err)
+	_, err = db.Exec("SELECT 1")
+	require.NoError(t, err)
+
+	// the next statement is not run in the transaction left open
+	require.Len(t, srv.queries, 2)
+	assert.Equal(t, `{}`, string(*srv.queries[1].Session))
+}
+
+func TestIsValid(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = echoSession
+
+	dc := newTestConn(t, srv.URL)
+	assert.True(t, dc.IsValid())
+	require.NoError(t, dc.ResetSession(context.Background()))
+
+	_, err := dc.exec(context.Background(), "BEGIN")
+	require.NoError(t, err)
+	assert.False(t, dc.IsValid())
+	assert.Equal(t, driver.ErrBadConn, dc.ResetSession(context.Background()))
+
+	dc = newTestConn(t, srv.URL)
+	dc.rest.checkBroken(errors.Wrap(ErrDoRequest, "connection reset by peer"))
+	assert.False(t, dc.IsValid())
+
+	dc = newTestConn(t, srv.URL)
+	require.NoError(t, dc.Close())
+	assert.False(t, dc.IsValid())
+}
@@ -6,6 +6,8 @@ const (
 	DatabendQueryIDHeader   = "X-DATABEND-QUERY-ID"
 	DatabendRouteHintHeader = "X-DATABEND-ROUTE-HINT"
 	DatabendQueryIDNode     = "X-DATABEND-NODE-ID"
+	DatabendSQLHeader       = "X-DATABEND-SQL"
+	DatabendQueryContext    = "X-DATABEND-QUERY-CONTEXT"
 	Authorization           = "Authorization"
 	WarehouseRoute          = "X-DATABEND-ROUTE"
 	UserAgent               = "User-Agent"
@@ -48,6 +48,17 @@ type Config struct {
 	// track the progress of query execution
 	StatsTracker QueryStatsTracker
 
+	// QueryIDGenerator generates the ids of the queries which are not given one by
+	// ContextKeyQueryID, default is a random uuid. QueryIDPrefix is prepended to the
+	// generated ids, such as the name of the service.
+	QueryIDGenerator QueryIDGenerator
+	QueryIDPrefix    string
+
+	// MultiStatement splits the scripts of ExecContext and QueryContext into statements
+	// executed one by one in the session, each statement of QueryContext has a result set
+	// reached by Rows.NextResultSet. It can be overridden by ContextKeyMultiStatement.
+	MultiStatement bool
+
 	// used on the storage which does not support presigned url like HDFS, local fs
 	PresignedURLDisabled bool
 
@@ -57,6 +68,39 @@ type Config struct {
 	// databend version should >= v1.2.345-nightly
 	EmptyFieldAs        string
 	EnableOpenTelemetry bool
+
+	// BatchBufferSize is the size in bytes that a batch insert keeps in memory before
+	// spilling the pending rows to a temporary file, default is 8MB
+	BatchBufferSize int64
+	// BatchTempDir is the directory of the batch spill files, default is os.TempDir()
+	BatchTempDir string
+	// BatchMaxRows and BatchMaxBytes make a batch insert cut a new stage file once the
+	// pending rows reach the limit, 0 means no limit
+	BatchMaxRows  int64
+	BatchMaxBytes int64
+	// BatchUploadWorkers is the number of stage files of a batch insert which could be
+	// uploaded concurrently, default is 1
+	BatchUploadWorkers int
+	// track the progress of batch inserts
+	BatchProgressTracker BatchProgressTracker
+	// BatchFormat is the file format uploaded by batch inserts, default is csv
+	BatchFormat BatchFormat
+	// BatchSpoolDir keeps the files of the pending batch inserts on disk along with a
+	// manifest, so they could be resumed by RecoverSpool after the process crashed, it
+	// may be shared by several processes
+	BatchSpoolDir string
+	// BatchDeduplicate labels the batch inserts by the hash of their data, so a batch
+	// inserted again is skipped by the server, a label set by ContextKeyDeduplicateLabel
+	// is preferred
+	BatchDeduplicate bool
+	// UploadTimeout is the timeout of a single request uploading to stage, default is 60s.
+	// The large files could be split into chunks by UploadFileToStage.
+	UploadTimeout time.Duration
+	// UploadRetries is the max attempts of an upload which could be retried, default is 3
+	UploadRetries int
+	// UploadCompression compresses the data uploaded by LoadReader and the batch inserts
+	// with gzip or zstd, default is no compression
+	UploadCompression Compression
 }
 
 // NewConfig creates a new config with default values
@@ -136,6 +180,45 @@ func (cfg *Config) FormatDSN() string {
 	if cfg.PresignedURLDisabled {
 		query.Set("presigned_url_disabled", "1")
 	}
+	if cfg.BatchBufferSize != 0 {
+		query.Set("batch_buffer_size", strconv.FormatInt(cfg.BatchBufferSize, 10))
+	}
+	if cfg.BatchTempDir != "" {
+		query.Set("batch_temp_dir", cfg.BatchTempDir)
+	}
+	if cfg.BatchMaxRows != 0 {
+		query.Set("batch_max_rows", strconv.FormatInt(cfg.BatchMaxRows, 10))
+	}
+	if cfg.BatchMaxBytes != 0 {
+		query.Set("batch_max_bytes", strconv.FormatInt(cfg.BatchMaxBytes, 10))
+	}
+	if cfg.BatchUploadWorkers != 0 {
+		query.Set("batch_upload_workers", strconv.Itoa(cfg.BatchUploadWorkers))
+	}
+	if cfg.BatchFormat != "" {
+		query.Set("batch_format", string(cfg.BatchFormat))
+	}
+	if cfg.BatchSpoolDir != "" {
+		query.Set("batch_spool_dir", cfg.BatchSpoolDir)
+	}
+	if cfg.UploadTimeout != 0 {
+		query.Set("upload_timeout", cfg.UploadTimeout.String())
+	}
+	if cfg.UploadRetries != 0 {
+		query.Set("upload_retries", strconv.Itoa(cfg.UploadRetries))
+	}
+	if cfg.UploadCompression != "" {
+		query.Set("upload_compression", string(cfg.UploadCompression))
+	}
+	if cfg.QueryIDPrefix != "" {
+		query.Set("query_id_prefix", cfg.QueryIDPrefix)
+	}
+	if cfg.MultiStatement {
+		query.Set("multi_statement", "1")
+	}
+	if cfg.BatchDeduplicate {
+		query.Set("batch_deduplicate", "1")
+	}
 	if cfg.EmptyFieldAs != "" {
 		query.Set("empty_field_as", cfg.EmptyFieldAs)
 	} else {
@@ -173,6 +256,32 @@ func (cfg *Config) AddParams(params map[string]string) (err error) {
 			cfg.PresignedURLDisabled, err = strconv.ParseBool(v)
 		case "empty_field_as":
 			cfg.EmptyFieldAs = v
+		case "batch_buffer_size":
+			cfg.BatchBufferSize, err = strconv.ParseInt(v, 10, 64)
+		case "batch_temp_dir":
+			cfg.BatchTempDir = v
+		case "batch_max_rows":
+			cfg.BatchMaxRows, err = strconv.ParseInt(v, 10, 64)
+		case "batch_max_bytes":
+			cfg.BatchMaxBytes, err = strconv.ParseInt(v, 10, 64)
+		case "batch_upload_workers":
+			cfg.BatchUploadWorkers, err = strconv.Atoi(v)
+		case "batch_format":
+			cfg.BatchFormat, err = parseBatchFormat(v)
+		case "batch_spool_dir":
+			cfg.BatchSpoolDir = v
+		case "upload_timeout":
+			cfg.UploadTimeout, err = time.ParseDuration(v)
+		case "upload_retries":
+			cfg.UploadRetries, err = strconv.Atoi(v)
+		case "upload_compression":
+			cfg.UploadCompression, err = parseUploadCompression(v)
+		case "query_id_prefix":
+			cfg.QueryIDPrefix, err = parseQueryIDPrefix(v)
+		case "multi_statement":
+			cfg.MultiStatement, err = strconv.ParseBool(v)
+		case "batch_deduplicate":
+			cfg.BatchDeduplicate, err = strconv.ParseBool(v)
 		case "tls_config":
 			cfg.TLSConfig = v
 		case "tenant":
@@ -0,0 +1,174 @@
+package godatabend
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const exportCleanupTimeout = 30 * time.Second
+
+// withoutCancelContext keeps the values of the context without its deadline and
+// cancellation, like context.WithoutCancel of go 1.21.
+type withoutCancelContext struct {
+	context.Context
+}
+
+func (withoutCancelContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (withoutCancelContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (withoutCancelContext) Err() error {
+	return nil
+}
+
+// ExportDest is where the exported files are downloaded, one of Dir and Writer must be set.
+type ExportDest struct {
+	// Dir is the local directory the files are downloaded into, by their names in the stage.
+	Dir string
+	// Writer receives the content of the result, which is then unloaded as a single file.
+	Writer io.Writer
+	// KeepStageFiles keeps the files in the stage after they are downloaded.
+	KeepStageFiles bool
+}
+
+// ExportFile is a file produced by Export.
+type ExportFile struct {
+	// Name is the path of the file in the stage.
+	Name string
+	// Path is the local path of the downloaded file, it's empty if the file is written
+	// into ExportDest.Writer.
+	Path string
+	Size int64
+	Rows int64
+}
+
+// ExportResult is the result of Export.
+type ExportResult struct {
+	// Stage is the directory holding the unloaded files, it's removed unless the files are kept.
+	Stage *StageLocation
+	Files []ExportFile
+	Rows  int64
+}
+
+// exportResultColumns are the columns of the detailed output of COPY INTO a stage, in
+// the order of the server if the schema is absent.
+var exportResultColumns = []string{"file_name", "file_size", "row_count"}
+
+// Export unloads the result of the query into the user stage in the format by
+// COPY INTO, CSV by default, and downloads the produced files through their presigned
+// urls into the destination.
+func (dc *DatabendConn) Export(ctx context.Context, query string, dest ExportDest, format FileFormat) (*ExportResult, error) {
+	if dc.rest == nil {
+		return nil, driver.ErrBadConn
+	}
+	if (dest.Dir == "") == (dest.Writer == nil) {
+		return nil, errors.New("either the directory or the writer of the export should be set")
+	}
+	if format == nil {
+		format = CSVFormat{}
+	}
+	clause, err := FileFormatClause(format)
+	if err != nil {
+		return nil, err
+	}
+	ctx = dc.rest.checkQueryID(ctx)
+	stage := &StageLocation{
+		Name: "~",
+		Path: fmt.Sprintf("export/%d-%s/", time.Now().Unix(), uuid.NewString()),
+	}
+	copySQL := fmt.Sprintf("COPY INTO %s FROM (%s) %s DETAILED_OUTPUT = true", stage, query, clause)
+	if dest.Writer != nil {
+		// a writer is not able to hold several files of the formats like parquet
+		copySQL += " SINGLE = true"
+	}
+	resp, err := dc.rest.QuerySync(ctx, copySQL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "copy into stage failed")
+	}
+	result, err := parseExportResult(resp, stage)
+	if err != nil {
+		return nil, err
+	}
+	if !dest.KeepStageFiles {
+		defer func() {
+			// the files are removed even if the export is canceled
+			ctx, cancel := context.WithTimeout(withoutCancelContext{ctx}, exportCleanupTimeout)
+			defer cancel()
+			if err := dc.rest.RemoveStageFiles(ctx, stage, ""); err != nil {
+				dc.log("remove export files failed: ", err)
+			}
+		}()
+	}
+
+	if dest.Dir != "" {
+		if err = os.MkdirAll(dest.Dir, 0755); err != nil {
+			return nil, errors.Wrap(err, "create export dir failed")
+		}
+	}
+	for i := range result.Files {
+		file := &result.Files[i]
+		location := &StageLocation{Name: stage.Name, Path: file.Name}
+		if dest.Writer != nil {
+			if _, err = dc.rest.DownloadStageFile(ctx, location, dest.Writer); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		file.Path = filepath.Join(dest.Dir, path.Base(file.Name))
+		if err = dc.downloadExportFile(ctx, location, file.Path); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (dc *DatabendConn) downloadExportFile(ctx context.Context, stage *StageLocation, localPath string) error {
+	f, err := os.Create(localPath)
+	if err != nil {
+		return errors.Wrap(err, "create export file failed")
+	}
+	_, err = dc.rest.DownloadStageFile(ctx, stage, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func parseExportResult(resp *QueryResponse, stage *StageLocation) (*ExportResult, error) {
+	rows := newResultRows(resp, exportResultColumns)
+	result := &ExportResult{Stage: stage}
+	for i := 0; i < rows.len(); i++ {
+		file := ExportFile{Name: rows.value(i, "file_name")}
+		if file.Name == "" {
+			return nil, errors.New("copy into stage returned no file name")
+		}
+		// the file name is relative to the directory of the stage on some servers
+		if !strings.HasPrefix(file.Name, stage.Path) {
+			file.Name = stage.Path + file.Name
+		}
+		var err error
+		if file.Size, err = rows.int64Value(i, "file_size"); err != nil {
+			return nil, err
+		}
+		if file.Rows, err = rows.int64Value(i, "row_count"); err != nil {
+			return nil, err
+		}
+		result.Files = append(result.Files, file)
+		result.Rows += file.Rows
+	}
+	return result, nil
+}
@@ -0,0 +1,122 @@
+package godatabend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newExportTestServer(t *testing.T, files map[string]string) *testServer {
+	srv := newTestServer(t)
+	srv.Config.Handler = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/download/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			name := strings.TrimPrefix(r.URL.Path, "/download/")
+			content, ok := files[filepath.Base(name)]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write([]byte(content))
+		})
+	}(srv.Config.Handler)
+	srv.onQuery = func(req QueryRequest) string {
+		switch {
+		case strings.HasPrefix(req.SQL, "COPY INTO"):
+			var data []string
+			for name, content := range files {
+				data = append(data, fmt.Sprintf(`["%s","%d","%d"]`, name, len(content), strings.Count(content, "\n")))
+			}
+			return fmt.Sprintf(`{"id":"q1","state":"Succeeded",
+"schema":[{"name":"file_name","type":"String"},{"name":"file_size","type":"UInt64"},{"name":"row_count","type":"UInt64"}],
+"data":[%s]}`, strings.Join(data, ","))
+		case strings.HasPrefix(req.SQL, "PRESIGN DOWNLOAD @~/"):
+			return fmt.Sprintf(`{"id":"q1","state":"Succeeded","data":[["GET","{}","%s/download/%s"]]}`,
+				srv.URL, strings.TrimPrefix(req.SQL, "PRESIGN DOWNLOAD @~/"))
+		}
+		return `{"id":"q1","state":"Succeeded"}`
+	}
+	return srv
+}
+
+func TestExportToDir(t *testing.T) {
+	files := map[string]string{
+		"data_0.csv": "1,a\n2,b\n",
+		"data_1.csv": "3,c\n",
+	}
+	srv := newExportTestServer(t, files)
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	dir := filepath.Join(t.TempDir(), "out")
+	result, err := dc.Export(context.Background(), "SELECT * FROM t", ExportDest{Dir: dir}, CSVFormat{})
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(3), result.Rows)
+	require.Len(t, result.Files, 2)
+	for _, file := range result.Files {
+		assert.True(t, strings.HasPrefix(file.Name, result.Stage.Path))
+		data, err := os.ReadFile(file.Path)
+		require.NoError(t, err)
+		assert.Equal(t, files[filepath.Base(file.Path)], string(data))
+		assert.Equal(t, int64(len(data)), file.Size)
+	}
+
+	sql := srv.queries[0].SQL
+	assert.Equal(t, fmt.Sprintf("COPY INTO %s FROM (SELECT * FROM t) FILE_FORMAT = (type = 'CSV') DETAILED_OUTPUT = true", result.Stage), sql)
+	last := srv.queries[len(srv.queries)-1].SQL
+	assert.Equal(t, fmt.Sprintf("REMOVE %s", result.Stage), last)
+}
+
+func TestExportToWriter(t *testing.T) {
+	srv := newExportTestServer(t, map[string]string{"data.ndjson": "{\"a\":1}\n"})
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	var buf bytes.Buffer
+	result, err := dc.Export(context.Background(), "SELECT 1 AS a", ExportDest{Writer: &buf, KeepStageFiles: true}, NDJSONFormat{})
+	require.NoError(t, err)
+	assert.Equal(t, "{\"a\":1}\n", buf.String())
+	assert.Equal(t, int64(1), result.Rows)
+	assert.True(t, strings.HasSuffix(srv.queries[0].SQL, "SINGLE = true"))
+	for _, q := range srv.queries {
+		assert.False(t, strings.HasPrefix(q.SQL, "REMOVE"))
+	}
+
+	_, err = dc.Export(context.Background(), "SELECT 1", ExportDest{}, nil)
+	assert.Error(t, err)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestExportCanceledRemovesFiles(t *testing.T) {
+	srv := newExportTestServer(t, map[string]string{"data.csv": "1,a\n"})
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer := writerFunc(func(p []byte) (int, error) {
+		cancel()
+		return 0, ctx.Err()
+	})
+	_, err := dc.Export(ctx, "SELECT 1", ExportDest{Writer: writer}, CSVFormat{})
+	require.Error(t, err)
+	last := srv.queries[len(srv.queries)-1].SQL
+	assert.True(t, strings.HasPrefix(last, "REMOVE @~/"), last)
+}
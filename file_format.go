@@ -0,0 +1,326 @@
+package godatabend
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Compression is the compression algorithm of the stage files.
+type Compression string
+
+const (
+	CompressionAuto       Compression = "auto"
+	CompressionNone       Compression = "none"
+	CompressionGzip       Compression = "gzip"
+	CompressionBz2        Compression = "bz2"
+	CompressionBrotli     Compression = "brotli"
+	CompressionZstd       Compression = "zstd"
+	CompressionDeflate    Compression = "deflate"
+	CompressionRawDeflate Compression = "raw_deflate"
+	CompressionXz         Compression = "xz"
+)
+
+func (c Compression) validate() error {
+	switch Compression(strings.ToLower(string(c))) {
+	case "", CompressionAuto, CompressionNone, CompressionGzip, CompressionBz2, CompressionBrotli,
+		CompressionZstd, CompressionDeflate, CompressionRawDeflate, CompressionXz:
+		return nil
+	}
+	return errors.Errorf("invalid compression %q", string(c))
+}
+
+// FileFormat is the format of the stage files used by InsertWithStage and COPY INTO,
+// it's implemented by CSVFormat, TSVFormat, NDJSONFormat, ParquetFormat and ORCFormat.
+// The zero value of an option leaves it to the server default.
+type FileFormat interface {
+	// Options validates the format and returns its file format options.
+	Options() (map[string]string, error)
+}
+
+// FileFormatClause returns the FILE_FORMAT clause of the format for COPY INTO.
+func FileFormatClause(f FileFormat) (string, error) {
+	options, err := f.Options()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("FILE_FORMAT = (%s)", formatFileFormatOptions(options)), nil
+}
+
+// CSVFormat is the CSV file format.
+type CSVFormat struct {
+	FieldDelimiter  string
+	RecordDelimiter string
+	SkipHeader      int
+	Quote           string
+	Escape          string
+	NanDisplay      string
+	// EmptyFieldAs is one of null, string and field_default.
+	EmptyFieldAs string
+	// BinaryFormat is one of hex and base64.
+	BinaryFormat string
+	OutputHeader bool
+	// ErrorOnColumnCountMismatch is true by default on the server.
+	ErrorOnColumnCountMismatch *bool
+	Compression                Compression
+}
+
+func (f CSVFormat) Options() (map[string]string, error) {
+	options := map[string]string{"type": "CSV"}
+	if err := setDelimiters(options, f.FieldDelimiter, f.RecordDelimiter); err != nil {
+		return nil, err
+	}
+	if f.SkipHeader < 0 {
+		return nil, errors.Errorf("invalid skip_header %d", f.SkipHeader)
+	}
+	if f.SkipHeader > 0 {
+		options["skip_header"] = strconv.Itoa(f.SkipHeader)
+	}
+	switch f.Quote {
+	case "", `"`, `'`, "`":
+	default:
+		return nil, errors.Errorf("invalid quote %q", f.Quote)
+	}
+	setOption(options, "quote", f.Quote)
+	switch f.Escape {
+	case "", `\`:
+	default:
+		return nil, errors.Errorf("invalid escape %q", f.Escape)
+	}
+	setOption(options, "escape", f.Escape)
+	setOption(options, "nan_display", f.NanDisplay)
+	if err := checkOptionValue("empty_field_as", f.EmptyFieldAs, "null", "string", "field_default"); err != nil {
+		return nil, err
+	}
+	setOption(options, EMPTY_FIELD_AS, f.EmptyFieldAs)
+	if err := checkOptionValue("binary_format", f.BinaryFormat, "hex", "base64"); err != nil {
+		return nil, err
+	}
+	setOption(options, "binary_format", f.BinaryFormat)
+	if f.OutputHeader {
+		options["output_header"] = "true"
+	}
+	if f.ErrorOnColumnCountMismatch != nil {
+		options["error_on_column_count_mismatch"] = strconv.FormatBool(*f.ErrorOnColumnCountMismatch)
+	}
+	if err := setCompression(options, f.Compression); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// TSVFormat is the tab separated file format.
+type TSVFormat struct {
+	FieldDelimiter  string
+	RecordDelimiter string
+	Compression     Compression
+}
+
+func (f TSVFormat) Options() (map[string]string, error) {
+	options := map[string]string{"type": "TSV"}
+	if err := setDelimiters(options, f.FieldDelimiter, f.RecordDelimiter); err != nil {
+		return nil, err
+	}
+	if err := setCompression(options, f.Compression); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// NDJSONFormat is the newline delimited JSON file format.
+type NDJSONFormat struct {
+	// NullFieldAs is one of null and field_default.
+	NullFieldAs string
+	// MissingFieldAs is one of error, null and field_default.
+	MissingFieldAs string
+	Compression    Compression
+}
+
+func (f NDJSONFormat) Options() (map[string]string, error) {
+	options := map[string]string{"type": "NDJSON"}
+	if err := checkOptionValue("null_field_as", f.NullFieldAs, "null", "field_default"); err != nil {
+		return nil, err
+	}
+	setOption(options, "null_field_as", f.NullFieldAs)
+	if err := checkOptionValue("missing_field_as", f.MissingFieldAs, "error", "null", "field_default"); err != nil {
+		return nil, err
+	}
+	setOption(options, "missing_field_as", f.MissingFieldAs)
+	if err := setCompression(options, f.Compression); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// ParquetFormat is the parquet file format, the data is compressed inside the files.
+type ParquetFormat struct {
+	// MissingFieldAs is one of error and field_default.
+	MissingFieldAs string
+}
+
+func (f ParquetFormat) Options() (map[string]string, error) {
+	options := map[string]string{"type": "PARQUET"}
+	if err := checkOptionValue("missing_field_as", f.MissingFieldAs, "error", "field_default"); err != nil {
+		return nil, err
+	}
+	setOption(options, "missing_field_as", f.MissingFieldAs)
+	return options, nil
+}
+
+// ORCFormat is the ORC file format, the data is compressed inside the files.
+type ORCFormat struct {
+	// MissingFieldAs is one of error and field_default.
+	MissingFieldAs string
+}
+
+func (f ORCFormat) Options() (map[string]string, error) {
+	options := map[string]string{"type": "ORC"}
+	if err := checkOptionValue("missing_field_as", f.MissingFieldAs, "error", "field_default"); err != nil {
+		return nil, err
+	}
+	setOption(options, "missing_field_as", f.MissingFieldAs)
+	return options, nil
+}
+
+// CopyOptions are the copy options of InsertWithStage and COPY INTO. The zero value of
+// an option leaves it to the server default.
+type CopyOptions struct {
+	// OnError is one of continue, abort and abort_N which aborts after N errors.
+	OnError string
+	// SizeLimit is the max bytes of data to load, 0 is unlimited.
+	SizeLimit int64
+	// MaxFiles is the max number of files to load, 0 is unlimited.
+	MaxFiles int
+	// Purge removes the files from the stage once they are loaded.
+	Purge bool
+	// Force loads the files which have been loaded before.
+	Force bool
+	// ReturnFailedOnly only returns the files failed to load in the COPY INTO result.
+	ReturnFailedOnly bool
+	// DisableVariantCheck loads invalid JSON into variant columns as strings.
+	DisableVariantCheck bool
+	// ColumnMatchMode is one of case_sensitive and case_insensitive.
+	ColumnMatchMode string
+}
+
+// Options validates and returns the copy options.
+func (o CopyOptions) Options() (map[string]string, error) {
+	options := map[string]string{}
+	if o.OnError != "" {
+		onError := strings.ToLower(o.OnError)
+		if n := strings.TrimPrefix(onError, "abort_"); n != onError {
+			if v, err := strconv.ParseUint(n, 10, 64); err != nil || v == 0 {
+				return nil, errors.Errorf("invalid on_error %q", o.OnError)
+			}
+		} else if err := checkOptionValue("on_error", onError, "continue", "abort"); err != nil {
+			return nil, err
+		}
+		options["on_error"] = onError
+	}
+	if o.SizeLimit < 0 {
+		return nil, errors.Errorf("invalid size_limit %d", o.SizeLimit)
+	}
+	if o.SizeLimit > 0 {
+		options["size_limit"] = strconv.FormatInt(o.SizeLimit, 10)
+	}
+	if o.MaxFiles < 0 {
+		return nil, errors.Errorf("invalid max_files %d", o.MaxFiles)
+	}
+	if o.MaxFiles > 0 {
+		options["max_files"] = strconv.Itoa(o.MaxFiles)
+	}
+	if o.Purge {
+		options[PURGE] = "true"
+	}
+	if o.Force {
+		options["force"] = "true"
+	}
+	if o.ReturnFailedOnly {
+		options["return_failed_only"] = "true"
+	}
+	if o.DisableVariantCheck {
+		options["disable_variant_check"] = "true"
+	}
+	if err := checkOptionValue("column_match_mode", o.ColumnMatchMode, "case_sensitive", "case_insensitive"); err != nil {
+		return nil, err
+	}
+	setOption(options, "column_match_mode", o.ColumnMatchMode)
+	return options, nil
+}
+
+// Clause returns the copy options as the tail of a COPY INTO statement.
+func (o CopyOptions) Clause() (string, error) {
+	options, err := o.Options()
+	if err != nil {
+		return "", err
+	}
+	return formatCopyOptions(options), nil
+}
+
+// copyKeywordOptions are the copy options whose values are keywords, not strings.
+var copyKeywordOptions = map[string]bool{"on_error": true, "column_match_mode": true}
+
+var keywordRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// formatCopyOptions renders the copy options of a COPY INTO statement like the file
+// format options, but the keywords are not quoted, e.g. on_error = continue.
+func formatCopyOptions(options map[string]string) string {
+	keys := make([]string, 0, len(options))
+	for k, v := range options {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	items := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := options[k]
+		if !copyKeywordOptions[strings.ToLower(k)] || !keywordRe.MatchString(v) {
+			v = formatOptionValue(v)
+		}
+		items = append(items, fmt.Sprintf("%s = %s", k, v))
+	}
+	return strings.Join(items, " ")
+}
+
+func setOption(options map[string]string, key, value string) {
+	if value != "" {
+		options[key] = value
+	}
+}
+
+func checkOptionValue(key, value string, valid ...string) error {
+	if value == "" {
+		return nil
+	}
+	for _, v := range valid {
+		if strings.EqualFold(value, v) {
+			return nil
+		}
+	}
+	return errors.Errorf("invalid %s %q, expect one of %s", key, value, strings.Join(valid, ", "))
+}
+
+func setDelimiters(options map[string]string, field, record string) error {
+	if len(field) > 1 {
+		return errors.Errorf("invalid field_delimiter %q, expect a single byte", field)
+	}
+	setOption(options, "field_delimiter", field)
+	if len(record) > 1 && record != "\r\n" {
+		return errors.Errorf("invalid record_delimiter %q, expect a single byte or \\r\\n", record)
+	}
+	setOption(options, "record_delimiter", record)
+	return nil
+}
+
+func setCompression(options map[string]string, c Compression) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	setOption(options, "compression", strings.ToUpper(string(c)))
+	return nil
+}
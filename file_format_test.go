@@ -0,0 +1,84 @@
+package godatabend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileFormatOptions(t *testing.T) {
+	mismatch := false
+	tests := []struct {
+		format  FileFormat
+		options map[string]string
+	}{
+		{CSVFormat{}, map[string]string{"type": "CSV"}},
+		{CSVFormat{
+			FieldDelimiter:             "|",
+			RecordDelimiter:            "\r\n",
+			SkipHeader:                 1,
+			Quote:                      `'`,
+			EmptyFieldAs:               "string",
+			ErrorOnColumnCountMismatch: &mismatch,
+			Compression:                CompressionGzip,
+		}, map[string]string{
+			"type":                           "CSV",
+			"field_delimiter":                "|",
+			"record_delimiter":               "\r\n",
+			"skip_header":                    "1",
+			"quote":                          `'`,
+			"empty_field_as":                 "string",
+			"error_on_column_count_mismatch": "false",
+			"compression":                    "GZIP",
+		}},
+		{TSVFormat{FieldDelimiter: "\t"}, map[string]string{"type": "TSV", "field_delimiter": "\t"}},
+		{NDJSONFormat{MissingFieldAs: "null", Compression: CompressionZstd}, map[string]string{"type": "NDJSON", "missing_field_as": "null", "compression": "ZSTD"}},
+		{ParquetFormat{}, map[string]string{"type": "PARQUET"}},
+		{ORCFormat{MissingFieldAs: "field_default"}, map[string]string{"type": "ORC", "missing_field_as": "field_default"}},
+	}
+	for _, tt := range tests {
+		options, err := tt.format.Options()
+		require.NoError(t, err)
+		assert.Equal(t, tt.options, options)
+	}
+
+	invalid := []FileFormat{
+		CSVFormat{FieldDelimiter: "||"},
+		CSVFormat{RecordDelimiter: "ab"},
+		CSVFormat{SkipHeader: -1},
+		CSVFormat{Quote: "x"},
+		CSVFormat{EmptyFieldAs: "nil"},
+		TSVFormat{Compression: "lz4"},
+		NDJSONFormat{NullFieldAs: "error"},
+		ParquetFormat{MissingFieldAs: "null"},
+	}
+	for _, f := range invalid {
+		_, err := f.Options()
+		assert.Error(t, err, "%+v", f)
+	}
+
+	clause, err := FileFormatClause(CSVFormat{FieldDelimiter: ",", SkipHeader: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "FILE_FORMAT = (field_delimiter = ',' skip_header = 1 type = 'CSV')", clause)
+}
+
+func TestCopyOptions(t *testing.T) {
+	options, err := CopyOptions{OnError: "ABORT_10", SizeLimit: 1024, Purge: true, ColumnMatchMode: "case_insensitive"}.Options()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"on_error":          "abort_10",
+		"size_limit":        "1024",
+		"purge":             "true",
+		"column_match_mode": "case_insensitive",
+	}, options)
+
+	clause, err := CopyOptions{OnError: "continue", Force: true}.Clause()
+	require.NoError(t, err)
+	assert.Equal(t, "force = true on_error = continue", clause)
+
+	for _, o := range []CopyOptions{{OnError: "skip"}, {OnError: "abort_0"}, {SizeLimit: -1}, {ColumnMatchMode: "any"}} {
+		_, err := o.Options()
+		assert.Error(t, err, "%+v", o)
+	}
+}
@@ -2,6 +2,7 @@ package godatabend
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,3 +50,49 @@ func generateDescTable(query string) (string, error) {
 	}
 	return fmt.Sprintf("DESC %s", table), nil
 }
+
+// resultRows reads the rows of a query result by the column names, the columns are
+// expected in the given order if the result has no schema.
+type resultRows struct {
+	index map[string]int
+	data  [][]*string
+}
+
+func newResultRows(resp *QueryResponse, columns []string) *resultRows {
+	index := map[string]int{}
+	if resp.Schema != nil && len(*resp.Schema) > 0 {
+		for i, field := range *resp.Schema {
+			index[strings.ToLower(field.Name)] = i
+		}
+	} else {
+		for i, name := range columns {
+			index[name] = i
+		}
+	}
+	return &resultRows{index: index, data: resp.Data}
+}
+
+func (r *resultRows) len() int {
+	return len(r.data)
+}
+
+// value returns the value of the column in the row, a null value is returned as "".
+func (r *resultRows) value(row int, name string) string {
+	i, ok := r.index[name]
+	if !ok || i >= len(r.data[row]) || r.data[row][i] == nil || *r.data[row][i] == "NULL" {
+		return ""
+	}
+	return *r.data[row][i]
+}
+
+func (r *resultRows) int64Value(row int, name string) (int64, error) {
+	v := r.value(row, name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s in the result", name)
+	}
+	return n, nil
+}
@@ -0,0 +1,280 @@
+package godatabend
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const defaultLoadWorkers = 4
+
+// LoadOptions tunes LoadReader and LoadFiles, a nil LoadOptions loads the files with the
+// default options of the format.
+type LoadOptions struct {
+	// FileFormat replaces the default file format options of the format.
+	FileFormat FileFormat
+	// FileFormatOptions replaces the default file format options of the format, it's
+	// ignored if FileFormat is set.
+	FileFormatOptions map[string]string
+	// Copy validates the copy options appended to the COPY INTO statement.
+	Copy *CopyOptions
+	// CopyOptions are appended to the COPY INTO statement, e.g. on_error = continue, it's
+	// ignored if Copy is set.
+	CopyOptions map[string]string
+	// Purge removes the staged files once they are loaded.
+	Purge bool
+	// Workers is the number of concurrent uploads, Config.BatchUploadWorkers or 4 by default.
+	Workers int
+}
+
+// copyOptions returns the copy options of the COPY INTO statement.
+func (o *LoadOptions) copyOptions() (map[string]string, error) {
+	options := map[string]string{}
+	if o == nil {
+		return options, nil
+	}
+	if o.Copy != nil {
+		copyOptions, err := o.Copy.Options()
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range copyOptions {
+			options[k] = v
+		}
+	} else {
+		for k, v := range o.CopyOptions {
+			options[k] = v
+		}
+	}
+	if o.Purge {
+		options[PURGE] = "true"
+	}
+	return options, nil
+}
+
+// CopyFileResult is the result of COPY INTO for a single file.
+type CopyFileResult struct {
+	// File is the path of the file in the stage.
+	File           string
+	RowsLoaded     int64
+	ErrorsSeen     int64
+	FirstError     string
+	FirstErrorLine int64
+}
+
+// LoadResult is the result of LoadReader and LoadFiles.
+type LoadResult struct {
+	// Stage is the directory holding the uploaded files, it's removed if the files are purged.
+	Stage      *StageLocation
+	Files      []CopyFileResult
+	RowsLoaded int64
+	ErrorsSeen int64
+}
+
+// LoadReader uploads the data of the reader as a single file of the format to the user
+// stage, and loads it into the table by COPY INTO.
+func (dc *DatabendConn) LoadReader(ctx context.Context, table string, r io.Reader, format BatchFormat, opts *LoadOptions) (*LoadResult, error) {
+	if dc.rest == nil {
+		return nil, driver.ErrBadConn
+	}
+	// the options are checked before the data is uploaded
+	if _, err := opts.copyOptions(); err != nil {
+		return nil, err
+	}
+	ctx = dc.rest.checkQueryID(ctx)
+	stage := newLoadStage()
+	file := &StageLocation{Name: stage.Name, Path: stage.Path + "data." + string(format)}
+	var tempDir string
+	if dc.cfg != nil {
+		tempDir = dc.cfg.BatchTempDir
+	}
+	if format != BatchFormatParquet && dc.rest.UploadCompression != "" {
+		file.Path += compressionExt(dc.rest.UploadCompression)
+		if err := dc.rest.uploadCompressed(ctx, file, r, tempDir); err != nil {
+			return nil, errors.Wrap(err, "upload to stage failed")
+		}
+		return dc.copyIntoTable(ctx, table, stage, format, opts, true)
+	}
+	if dc.rest.PresignedURLDisabled {
+		if err := dc.rest.UploadToStageByAPI(ctx, file, bufio.NewReader(r)); err != nil {
+			return nil, errors.Wrap(err, "upload to stage failed")
+		}
+	} else {
+		// the presigned upload requires the size of the data, it's buffered first
+		buf := newBatchBuffer(0, tempDir)
+		defer buf.Close()
+		if _, err := io.Copy(buf, r); err != nil {
+			return nil, errors.Wrap(err, "read load data failed")
+		}
+		presigned, err := dc.rest.GetPresignedURL(ctx, file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get presigned url")
+		}
+		err = dc.rest.uploadWithRetry(ctx, file, presigned, func() (io.Reader, int64, error) {
+			input, err := buf.Reader()
+			if err != nil {
+				return nil, 0, errors.Wrap(err, "read load data failed")
+			}
+			return input, buf.Size(), nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "upload to stage failed")
+		}
+	}
+	return dc.copyIntoTable(ctx, table, stage, format, opts, false)
+}
+
+// LoadFiles uploads the local files matching the glob pattern to the user stage in
+// parallel, and loads them into the table by a single COPY INTO.
+func (dc *DatabendConn) LoadFiles(ctx context.Context, table string, glob string, format BatchFormat, opts *LoadOptions) (*LoadResult, error) {
+	if dc.rest == nil {
+		return nil, driver.ErrBadConn
+	}
+	// the options are checked before the data is uploaded
+	if _, err := opts.copyOptions(); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(glob)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid file pattern")
+	}
+	if len(files) == 0 {
+		return nil, errors.Errorf("no file matches %s", glob)
+	}
+	ctx = dc.rest.checkQueryID(ctx)
+	stage := newLoadStage()
+	if err = dc.uploadLoadFiles(ctx, stage, files, dc.loadWorkers(opts)); err != nil {
+		return nil, errors.Wrap(err, "upload to stage failed")
+	}
+	return dc.copyIntoTable(ctx, table, stage, format, opts, false)
+}
+
+func newLoadStage() *StageLocation {
+	return &StageLocation{
+		Name: "~",
+		Path: fmt.Sprintf("load/%d-%s/", time.Now().Unix(), uuid.NewString()),
+	}
+}
+
+func (dc *DatabendConn) loadWorkers(opts *LoadOptions) int {
+	if opts != nil && opts.Workers > 0 {
+		return opts.Workers
+	}
+	if dc.cfg != nil && dc.cfg.BatchUploadWorkers > 0 {
+		return dc.cfg.BatchUploadWorkers
+	}
+	return defaultLoadWorkers
+}
+
+func (dc *DatabendConn) uploadLoadFiles(ctx context.Context, stage *StageLocation, files []string, workers int) error {
+	pool := newUploadPool(dc.rest, workers)
+	for i, path := range files {
+		if pool.uploadErr() != nil {
+			break
+		}
+		// the files are numbered in case the pattern matches the same name in several directories
+		file := &StageLocation{
+			Name: stage.Name,
+			Path: fmt.Sprintf("%s%05d-%s", stage.Path, i+1, filepath.Base(path)),
+		}
+		path := path
+		err := pool.upload(ctx, file, func(presigned *PresignedResponse) error {
+			if err := dc.uploadLoadFile(ctx, path, file, presigned); err != nil {
+				return errors.Wrapf(err, "upload %s failed", path)
+			}
+			return nil
+		})
+		if err != nil {
+			_ = pool.wait()
+			return err
+		}
+	}
+	return pool.wait()
+}
+
+func (dc *DatabendConn) uploadLoadFile(ctx context.Context, path string, stage *StageLocation, presigned *PresignedResponse) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return dc.rest.uploadWithRetry(ctx, stage, presigned, func() (io.Reader, int64, error) {
+		return io.NewSectionReader(f, 0, fi.Size()), fi.Size(), nil
+	})
+}
+
+// copyIntoTable loads the files of the stage into the table, the compressed files are
+// compressed by Config.UploadCompression.
+func (dc *DatabendConn) copyIntoTable(ctx context.Context, table string, stage *StageLocation, format BatchFormat, opts *LoadOptions, compressed bool) (*LoadResult, error) {
+	if opts == nil {
+		opts = &LoadOptions{}
+	}
+	fileFormatOptions := opts.FileFormatOptions
+	if opts.FileFormat != nil {
+		var err error
+		if fileFormatOptions, err = opts.FileFormat.Options(); err != nil {
+			return nil, err
+		}
+	} else if fileFormatOptions == nil {
+		fileFormatOptions = dc.rest.batchFormatOptions(format)
+	}
+	if compressed {
+		fileFormatOptions = dc.rest.withUploadCompression(fileFormatOptions)
+	}
+	copyOptions, err := opts.copyOptions()
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("COPY INTO %s FROM %s FILE_FORMAT = (%s)", table, stage, formatFileFormatOptions(fileFormatOptions))
+	if len(copyOptions) > 0 {
+		query += " " + formatCopyOptions(copyOptions)
+	}
+	resp, err := dc.rest.QuerySync(ctx, query, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "copy into table failed")
+	}
+	result, err := parseCopyResult(resp)
+	if err != nil {
+		return nil, err
+	}
+	result.Stage = stage
+	return result, nil
+}
+
+// copyResultColumns are the columns of the COPY INTO result, in the order of the
+// server if the schema is absent.
+var copyResultColumns = []string{"file", "rows_loaded", "errors_seen", "first_error", "first_error_line"}
+
+func parseCopyResult(resp *QueryResponse) (*LoadResult, error) {
+	rows := newResultRows(resp, copyResultColumns)
+	result := &LoadResult{}
+	for i := 0; i < rows.len(); i++ {
+		file := CopyFileResult{File: rows.value(i, "file"), FirstError: rows.value(i, "first_error")}
+		var err error
+		if file.RowsLoaded, err = rows.int64Value(i, "rows_loaded"); err != nil {
+			return nil, err
+		}
+		if file.ErrorsSeen, err = rows.int64Value(i, "errors_seen"); err != nil {
+			return nil, err
+		}
+		if file.FirstErrorLine, err = rows.int64Value(i, "first_error_line"); err != nil {
+			return nil, err
+		}
+		result.Files = append(result.Files, file)
+		result.RowsLoaded += file.RowsLoaded
+		result.ErrorsSeen += file.ErrorsSeen
+	}
+	return result, nil
+}
@@ -0,0 +1,86 @@
+package godatabend
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const copyResultResponse = `{"id":"q1","state":"Succeeded",
+"schema":[{"name":"File","type":"String"},{"name":"Rows_loaded","type":"Int32"},{"name":"Errors_seen","type":"Int32"},{"name":"First_error","type":"Nullable(String)"},{"name":"First_error_line","type":"Nullable(Int32)"}],
+"data":[["a.csv","2","0",null,null],["b.csv","1","1","invalid value","2"]]}`
+
+func TestLoadFiles(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		return copyResultResponse
+	}
+
+	dir := t.TempDir()
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d.csv", i)), []byte(fmt.Sprintf("%d,a\n", i)), 0644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.txt"), []byte("x"), 0644))
+
+	dc := newTestConn(t, srv.URL)
+	result, err := dc.LoadFiles(context.Background(), "t", filepath.Join(dir, "*.csv"), BatchFormatCSV, &LoadOptions{
+		CopyOptions: map[string]string{"on_error": "continue"},
+		Purge:       true,
+		Workers:     2,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, srv.uploads, 3)
+	assert.Equal(t, "2,a\n", string(srv.uploads[result.Stage.Path+"00002-f2.csv"]))
+
+	require.Len(t, srv.queries, 1)
+	sql := srv.queries[0].SQL
+	assert.True(t, strings.HasPrefix(sql, fmt.Sprintf("COPY INTO t FROM %s FILE_FORMAT = (", result.Stage)), sql)
+	assert.True(t, strings.HasSuffix(sql, "on_error = continue purge = true"), sql)
+
+	assert.Equal(t, int64(3), result.RowsLoaded)
+	assert.Equal(t, int64(1), result.ErrorsSeen)
+	assert.Equal(t, []CopyFileResult{
+		{File: "a.csv", RowsLoaded: 2},
+		{File: "b.csv", RowsLoaded: 1, ErrorsSeen: 1, FirstError: "invalid value", FirstErrorLine: 2},
+	}, result.Files)
+
+	_, err = dc.LoadFiles(context.Background(), "t", filepath.Join(dir, "*.parquet"), BatchFormatParquet, nil)
+	assert.Error(t, err)
+}
+
+func TestLoadReader(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		return copyResultResponse
+	}
+
+	dc := newTestConn(t, srv.URL)
+	result, err := dc.LoadReader(context.Background(), "t", strings.NewReader(`{"a":1}`), BatchFormatNDJSON, nil)
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(srv.uploads[result.Stage.Path+"data.ndjson"]))
+	assert.Contains(t, srv.queries[0].SQL, "FILE_FORMAT = (type = 'NDJSON')")
+	assert.NotContains(t, srv.queries[0].SQL, "purge")
+
+	// the typed copy options are validated, and replace the map
+	opts := &LoadOptions{
+		Copy:        &CopyOptions{OnError: "abort_5", ColumnMatchMode: "case_insensitive"},
+		CopyOptions: map[string]string{"force": "true"},
+	}
+	_, err = dc.LoadReader(context.Background(), "t", strings.NewReader(`{"a":1}`), BatchFormatNDJSON, opts)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(srv.queries[1].SQL, "column_match_mode = case_insensitive on_error = abort_5"), srv.queries[1].SQL)
+	opts.Copy.OnError = "skip"
+	uploads := len(srv.uploads)
+	_, err = dc.LoadReader(context.Background(), "t", strings.NewReader(`{"a":1}`), BatchFormatNDJSON, opts)
+	assert.Error(t, err)
+	assert.Len(t, srv.uploads, uploads)
+}
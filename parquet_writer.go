@@ -0,0 +1,461 @@
+package godatabend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// A minimal parquet writer for the batch insert files: flat columns only, PLAIN
+// encoding, no compression and a single data page per column chunk.
+// https://github.com/apache/parquet-format/blob/master/src/main/thrift/parquet.thrift
+
+var parquetMagic = []byte("PAR1")
+
+// parquet physical types
+const (
+	parquetBoolean   int32 = 0
+	parquetInt32     int32 = 1
+	parquetInt64     int32 = 2
+	parquetFloat     int32 = 4
+	parquetDouble    int32 = 5
+	parquetByteArray int32 = 6
+)
+
+// parquet converted types, parquetConvertedNone means no annotation
+const (
+	parquetConvertedNone   int32 = -1
+	parquetUTF8            int32 = 0
+	parquetDecimal         int32 = 5
+	parquetDate            int32 = 6
+	parquetTimestampMicros int32 = 10
+	parquetUint8           int32 = 11
+	parquetUint16          int32 = 12
+	parquetUint32          int32 = 13
+	parquetUint64          int32 = 14
+	parquetInt8            int32 = 15
+	parquetInt16           int32 = 16
+	parquetJSON            int32 = 19
+)
+
+const (
+	parquetEncodingPlain int32 = 0
+	parquetEncodingRLE   int32 = 3
+
+	defaultParquetRowGroupRows = 64 * 1024
+)
+
+type parquetColumn struct {
+	name      string
+	typ       int32
+	converted int32
+	nullable  bool
+	// precision and scale of the DECIMAL columns
+	precision int32
+	scale     int32
+
+	numValues int
+	defLevels []bool
+	bools     []bool
+	values    bytes.Buffer
+}
+
+// check returns the error of a value which can't be appended to the column, so a row is
+// validated as a whole before any of its values is appended.
+func (c *parquetColumn) check(v interface{}) error {
+	if v == nil {
+		if !c.nullable {
+			return errors.Errorf("column %s is not nullable", c.name)
+		}
+		return nil
+	}
+	var ok bool
+	switch c.typ {
+	case parquetBoolean:
+		_, ok = v.(bool)
+	case parquetInt32:
+		_, ok = v.(int32)
+	case parquetInt64:
+		_, ok = v.(int64)
+	case parquetFloat:
+		_, ok = v.(float32)
+	case parquetDouble:
+		_, ok = v.(float64)
+	case parquetByteArray:
+		_, ok = v.([]byte)
+	default:
+		return errors.Errorf("unsupported parquet type %d", c.typ)
+	}
+	if !ok {
+		return errors.Errorf("invalid value of type %T for column %s", v, c.name)
+	}
+	return nil
+}
+
+// append appends a value passed check.
+func (c *parquetColumn) append(v interface{}) {
+	if c.nullable {
+		c.defLevels = append(c.defLevels, v != nil)
+	}
+	if v != nil {
+		var b [8]byte
+		switch c.typ {
+		case parquetBoolean:
+			c.bools = append(c.bools, v.(bool))
+		case parquetInt32:
+			binary.LittleEndian.PutUint32(b[:4], uint32(v.(int32)))
+			c.values.Write(b[:4])
+		case parquetInt64:
+			binary.LittleEndian.PutUint64(b[:], uint64(v.(int64)))
+			c.values.Write(b[:])
+		case parquetFloat:
+			binary.LittleEndian.PutUint32(b[:4], math.Float32bits(v.(float32)))
+			c.values.Write(b[:4])
+		case parquetDouble:
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(v.(float64)))
+			c.values.Write(b[:])
+		case parquetByteArray:
+			data := v.([]byte)
+			binary.LittleEndian.PutUint32(b[:4], uint32(len(data)))
+			c.values.Write(b[:4])
+			c.values.Write(data)
+		}
+	}
+	c.numValues++
+}
+
+// size is the estimated bytes of the buffered page.
+func (c *parquetColumn) size() int64 {
+	return int64(c.values.Len() + len(c.bools)/8 + len(c.defLevels)/8)
+}
+
+// page encodes the buffered values as a data page and resets the column.
+func (c *parquetColumn) page() []byte {
+	var page bytes.Buffer
+	if c.nullable {
+		levels := encodeBitPacked(c.defLevels)
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(len(levels)))
+		page.Write(b[:])
+		page.Write(levels)
+	}
+	if c.typ == parquetBoolean {
+		page.Write(packBits(c.bools))
+	} else {
+		page.Write(c.values.Bytes())
+	}
+	c.numValues = 0
+	c.defLevels = c.defLevels[:0]
+	c.bools = c.bools[:0]
+	c.values.Reset()
+	return page.Bytes()
+}
+
+type parquetChunk struct {
+	offset    int64
+	size      int64
+	numValues int64
+}
+
+type parquetRowGroup struct {
+	numRows int64
+	size    int64
+	chunks  []parquetChunk
+}
+
+type parquetWriter struct {
+	w            io.Writer
+	offset       int64
+	columns      []*parquetColumn
+	rows         int64
+	totalRows    int64
+	rowGroupRows int64
+	rowGroups    []parquetRowGroup
+}
+
+func newParquetWriter(w io.Writer, columns []*parquetColumn) *parquetWriter {
+	return &parquetWriter{
+		w:            w,
+		columns:      columns,
+		rowGroupRows: defaultParquetRowGroupRows,
+	}
+}
+
+func (p *parquetWriter) write(data []byte) error {
+	n, err := p.w.Write(data)
+	p.offset += int64(n)
+	return err
+}
+
+// WriteRow appends a row, the values must be nil or of the go type matching the
+// physical type of the column: bool, int32, int64, float32, float64 or []byte. A row
+// with an invalid value is not appended at all.
+func (p *parquetWriter) WriteRow(values []interface{}) error {
+	if len(values) != len(p.columns) {
+		return errors.Errorf("expect %d values, got %d", len(p.columns), len(values))
+	}
+	for i, v := range values {
+		if err := p.columns[i].check(v); err != nil {
+			return err
+		}
+	}
+	for i, v := range values {
+		p.columns[i].append(v)
+	}
+	p.rows++
+	if p.rows >= p.rowGroupRows {
+		return p.flushRowGroup()
+	}
+	return nil
+}
+
+// Buffered returns the estimated bytes of the rows not yet written out.
+func (p *parquetWriter) Buffered() int64 {
+	var size int64
+	for _, c := range p.columns {
+		size += c.size()
+	}
+	return size
+}
+
+func (p *parquetWriter) flushRowGroup() error {
+	if p.offset == 0 {
+		if err := p.write(parquetMagic); err != nil {
+			return err
+		}
+	}
+	if p.rows == 0 {
+		return nil
+	}
+	rg := parquetRowGroup{numRows: p.rows}
+	for _, c := range p.columns {
+		numValues := c.numValues
+		page := c.page()
+		header := encodeParquetPageHeader(numValues, len(page))
+		chunk := parquetChunk{
+			offset:    p.offset,
+			size:      int64(len(header) + len(page)),
+			numValues: int64(numValues),
+		}
+		if err := p.write(header); err != nil {
+			return err
+		}
+		if err := p.write(page); err != nil {
+			return err
+		}
+		rg.chunks = append(rg.chunks, chunk)
+		rg.size += chunk.size
+	}
+	p.rowGroups = append(p.rowGroups, rg)
+	p.totalRows += p.rows
+	p.rows = 0
+	return nil
+}
+
+// Close flushes the pending rows and writes the file footer.
+func (p *parquetWriter) Close() error {
+	if err := p.flushRowGroup(); err != nil {
+		return err
+	}
+	footer := p.encodeFileMetaData()
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(len(footer)))
+	if err := p.write(footer); err != nil {
+		return err
+	}
+	if err := p.write(b[:]); err != nil {
+		return err
+	}
+	return p.write(parquetMagic)
+}
+
+func encodeParquetPageHeader(numValues, size int) []byte {
+	t := newThriftWriter()
+	t.i32(1, 0) // DATA_PAGE
+	t.i32(2, int32(size))
+	t.i32(3, int32(size))
+	t.structBegin(5)
+	t.i32(1, int32(numValues))
+	t.i32(2, parquetEncodingPlain)
+	t.i32(3, parquetEncodingRLE)
+	t.i32(4, parquetEncodingRLE)
+	t.structEnd()
+	return t.end()
+}
+
+func (p *parquetWriter) encodeFileMetaData() []byte {
+	t := newThriftWriter()
+	t.i32(1, 1)
+	t.listBegin(2, thriftStruct, len(p.columns)+1)
+	t.elemBegin()
+	t.binary(4, []byte("schema"))
+	t.i32(5, int32(len(p.columns)))
+	t.structEnd()
+	for _, c := range p.columns {
+		t.elemBegin()
+		t.i32(1, c.typ)
+		if c.nullable {
+			t.i32(3, 1) // OPTIONAL
+		} else {
+			t.i32(3, 0) // REQUIRED
+		}
+		t.binary(4, []byte(c.name))
+		if c.converted != parquetConvertedNone {
+			t.i32(6, c.converted)
+		}
+		if c.converted == parquetDecimal {
+			t.i32(7, c.scale)
+			t.i32(8, c.precision)
+		}
+		t.structEnd()
+	}
+	t.i64(3, p.totalRows)
+	t.listBegin(4, thriftStruct, len(p.rowGroups))
+	for _, rg := range p.rowGroups {
+		t.elemBegin()
+		t.listBegin(1, thriftStruct, len(rg.chunks))
+		for i, chunk := range rg.chunks {
+			c := p.columns[i]
+			t.elemBegin()
+			t.i64(2, chunk.offset)
+			t.structBegin(3)
+			t.i32(1, c.typ)
+			t.listBegin(2, thriftI32, 2)
+			t.elemI32(parquetEncodingPlain)
+			t.elemI32(parquetEncodingRLE)
+			t.listBegin(3, thriftBinary, 1)
+			t.elemBinary([]byte(c.name))
+			t.i32(4, 0) // UNCOMPRESSED
+			t.i64(5, chunk.numValues)
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.structEnd()
+			t.structEnd()
+		}
+		t.i64(2, rg.size)
+		t.i64(3, rg.numRows)
+		t.structEnd()
+	}
+	t.binary(6, []byte(fmt.Sprintf("databend-go version %s", version)))
+	return t.end()
+}
+
+// encodeBitPacked encodes the definition levels of bit width 1 as a single bit-packed
+// run of the RLE/bit-packing hybrid encoding.
+func encodeBitPacked(levels []bool) []byte {
+	groups := (len(levels) + 7) / 8
+	var buf bytes.Buffer
+	writeUvarint(&buf, uint64(groups)<<1|1)
+	buf.Write(packBits(levels))
+	return buf.Bytes()
+}
+
+func packBits(bits []bool) []byte {
+	data := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		if b {
+			data[i/8] |= 1 << (i % 8)
+		}
+	}
+	return data
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	buf.Write(b[:n])
+}
+
+// thrift compact protocol types
+const (
+	thriftI32    byte = 5
+	thriftI64    byte = 6
+	thriftBinary byte = 8
+	thriftList   byte = 9
+	thriftStruct byte = 12
+)
+
+// thriftWriter writes a struct with the thrift compact protocol.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{last: []int16{0}}
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	delta := id - t.last[len(t.last)-1]
+	if delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		writeUvarint(&t.buf, uint64(zigzag64(int64(id))))
+	}
+	t.last[len(t.last)-1] = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.elemI32(v)
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	writeUvarint(&t.buf, zigzag64(v))
+}
+
+func (t *thriftWriter) binary(id int16, v []byte) {
+	t.fieldHeader(id, thriftBinary)
+	t.elemBinary(v)
+}
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.elemBegin()
+}
+
+func (t *thriftWriter) structEnd() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) listBegin(id int16, elemType byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		writeUvarint(&t.buf, uint64(size))
+	}
+}
+
+// elemBegin starts a struct element of a list, it must be closed by structEnd.
+func (t *thriftWriter) elemBegin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) elemI32(v int32) {
+	writeUvarint(&t.buf, zigzag64(int64(v)))
+}
+
+func (t *thriftWriter) elemBinary(v []byte) {
+	writeUvarint(&t.buf, uint64(len(v)))
+	t.buf.Write(v)
+}
+
+// end closes the top level struct and returns the encoded bytes.
+func (t *thriftWriter) end() []byte {
+	t.buf.WriteByte(0)
+	return t.buf.Bytes()
+}
+
+func zigzag64(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
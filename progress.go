@@ -0,0 +1,108 @@
+package godatabend
+
+import (
+	"context"
+	"sync"
+)
+
+// QueryLifecycle is the state of a query observed by WithProgress.
+type QueryLifecycle string
+
+const (
+	// QueryQueued is the query waiting for the resources of the warehouse.
+	QueryQueued QueryLifecycle = "queued"
+	// QueryRunning is the query running, or its result still being read.
+	QueryRunning QueryLifecycle = "running"
+	// QueryFinished is the query succeeded with all the result read.
+	QueryFinished QueryLifecycle = "finished"
+	// QueryFailed is the query failed on the server or abandoned by the client.
+	QueryFailed QueryLifecycle = "failed"
+)
+
+// QueryProgressEvent is passed to the observer of WithProgress on every response of a
+// query.
+type QueryProgressEvent struct {
+	QueryID string
+	State   QueryLifecycle
+	// StateChanged is true if the state is different from the previous event.
+	StateChanged bool
+	// Pages is the number of responses received for the query, including the first one.
+	Pages int
+	// Stats are the latest stats of the query, they are the final stats when the state
+	// is finished or failed. It's nil if the server has not responded any.
+	Stats *QueryStats
+	// Err is the error of the query if it failed.
+	Err error
+}
+
+// Done reports whether it's the last event of the query.
+func (e QueryProgressEvent) Done() bool {
+	return e.State == QueryFinished || e.State == QueryFailed
+}
+
+// QueryProgressFunc observes the progress of the queries started with the context of
+// WithProgress, the calls are never concurrent.
+type QueryProgressFunc func(event QueryProgressEvent)
+
+type contextKeyProgress struct{}
+
+// WithProgress returns a context which reports the scan, write and result progress,
+// the state transitions, the page count and the final stats of the queries started
+// with it to fn. Unlike Config.StatsTracker it applies to these queries only.
+func WithProgress(ctx context.Context, fn QueryProgressFunc) context.Context {
+	return context.WithValue(ctx, contextKeyProgress{}, &progressObserver{fn: fn})
+}
+
+type progressObserver struct {
+	fn QueryProgressFunc
+
+	mu    sync.Mutex
+	event QueryProgressEvent
+}
+
+func progressObserverFrom(ctx context.Context) *progressObserver {
+	o, _ := ctx.Value(contextKeyProgress{}).(*progressObserver)
+	return o
+}
+
+// start resets the observer for a new query started with the context.
+func (o *progressObserver) start(queryID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.event = QueryProgressEvent{QueryID: queryID}
+}
+
+// observe reports a response of the query, or the error of the request.
+func (o *progressObserver) observe(resp *QueryResponse, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.event.Done() {
+		return
+	}
+	state := QueryFailed
+	if err == nil {
+		o.event.Pages++
+		if resp.ID != "" {
+			o.event.QueryID = resp.ID
+		}
+		if resp.Stats != nil {
+			stats := *resp.Stats
+			o.event.Stats = &stats
+		}
+		switch {
+		case resp.Error != nil:
+			err = resp.Error
+		case resp.State == "Failed":
+		case resp.ReadFinished():
+			state = QueryFinished
+		case resp.State == "Starting":
+			state = QueryQueued
+		default:
+			state = QueryRunning
+		}
+	}
+	o.event.StateChanged = state != o.event.State
+	o.event.State = state
+	o.event.Err = err
+	o.fn(o.event)
+}
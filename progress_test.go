@@ -0,0 +1,71 @@
+package godatabend
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithProgress(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		return `{"id":"q1","state":"Starting","next_uri":"/v1/query/q1/page/1","final_uri":"/v1/query/q1/final"}`
+	}
+	srv.onPage = func(r *http.Request) string {
+		switch r.URL.Path {
+		case "/v1/query/q1/page/1":
+			return `{"id":"q1","state":"Running","next_uri":"/v1/query/q1/page/2","final_uri":"/v1/query/q1/final",
+"stats":{"scan_progress":{"rows":10,"bytes":100}}}`
+		case "/v1/query/q1/page/2":
+			return `{"id":"q1","state":"Succeeded","next_uri":"/v1/query/q1/final","final_uri":"/v1/query/q1/final",
+"stats":{"scan_progress":{"rows":20,"bytes":200},"result_progress":{"rows":1,"bytes":8}}}`
+		}
+		return `{"id":"q1","state":"Succeeded"}`
+	}
+
+	var events []QueryProgressEvent
+	ctx := WithProgress(context.Background(), func(event QueryProgressEvent) {
+		events = append(events, event)
+	})
+	_, err := newTestConn(t, srv.URL).rest.QuerySync(ctx, "SELECT count(*) FROM t", nil)
+	require.NoError(t, err)
+
+	require.Len(t, events, 3)
+	assert.Equal(t, []QueryLifecycle{QueryQueued, QueryRunning, QueryFinished},
+		[]QueryLifecycle{events[0].State, events[1].State, events[2].State})
+	for i, event := range events {
+		assert.Equal(t, "q1", event.QueryID)
+		assert.Equal(t, i+1, event.Pages)
+		assert.True(t, event.StateChanged)
+		assert.NoError(t, event.Err)
+	}
+	assert.Nil(t, events[0].Stats)
+	assert.Equal(t, uint64(10), events[1].Stats.ScanProgress.Rows)
+	assert.True(t, events[2].Done())
+	assert.Equal(t, uint64(20), events[2].Stats.ScanProgress.Rows)
+	assert.Equal(t, uint64(1), events[2].Stats.ResultProgress.Rows)
+}
+
+func TestWithProgressFailed(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		return `{"id":"q2","state":"Failed","error":{"code":1025,"message":"Unknown table"}}`
+	}
+
+	var events []QueryProgressEvent
+	ctx := WithProgress(context.Background(), func(event QueryProgressEvent) {
+		events = append(events, event)
+	})
+	_, err := newTestConn(t, srv.URL).rest.QuerySync(ctx, "SELECT * FROM t", nil)
+	require.Error(t, err)
+
+	require.Len(t, events, 1)
+	assert.Equal(t, QueryFailed, events[0].State)
+	assert.Equal(t, "q2", events[0].QueryID)
+	assert.ErrorContains(t, events[0].Err, "Unknown table")
+}
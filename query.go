@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+
+	"github.com/pkg/errors"
 )
 
 type QueryError struct {
@@ -78,8 +80,68 @@ type QueryRequest struct {
 	StageAttachment *StageAttachmentConfig `json:"stage_attachment,omitempty"`
 }
 
+// QueryIDGenerator generates the ids of the queries, which are sent in the
+// X-DATABEND-QUERY-ID header, so they must be made of letters, digits, '-', '_' and '.'.
+// It can be specified in the Config struct.
 type QueryIDGenerator func() string
 
+// maxQueryIDLength is the max length of a query id, including the prefix.
+const maxQueryIDLength = 128
+
+// validateQueryID checks the query id generated by the client, so a broken generator
+// is caught before its ids reach the server.
+func validateQueryID(id string) error {
+	if id == "" {
+		return errors.New("query id is empty")
+	}
+	if len(id) > maxQueryIDLength {
+		return errors.Errorf("query id %q is longer than %d", id, maxQueryIDLength)
+	}
+	if err := validateQueryIDChars(id); err != nil {
+		return errors.Wrapf(err, "invalid query id %q", id)
+	}
+	return nil
+}
+
+// validateCallerQueryID checks the query id given by the caller can be sent in the
+// header, the server decides whether it accepts the id.
+func validateCallerQueryID(id string) error {
+	if id == "" {
+		return errors.New("query id is empty")
+	}
+	if i := strings.IndexFunc(id, isControl); i >= 0 {
+		return errors.Errorf("invalid query id %q, unexpected control character %q", id, id[i])
+	}
+	return nil
+}
+
+// isControl reports whether the character is not allowed in a header value.
+func isControl(r rune) bool {
+	return (r < ' ' && r != '\t') || r == 0x7f
+}
+
+func validateQueryIDChars(s string) error {
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return errors.Errorf("unexpected character %q, expect letters, digits, '-', '_' or '.'", r)
+		}
+	}
+	return nil
+}
+
+// parseQueryIDPrefix parses the prefix of the generated query ids.
+func parseQueryIDPrefix(v string) (string, error) {
+	if len(v) > maxQueryIDLength/2 {
+		return "", errors.Errorf("query id prefix %q is longer than %d", v, maxQueryIDLength/2)
+	}
+	if err := validateQueryIDChars(v); err != nil {
+		return "", errors.Wrapf(err, "invalid query id prefix %q", v)
+	}
+	return v, nil
+}
+
 type PaginationConfig struct {
 	WaitTime        int64 `json:"wait_time_secs,omitempty"`
 	MaxRowsInBuffer int64 `json:"max_rows_in_buffer,omitempty"`
@@ -91,6 +153,8 @@ type TxnState string
 const (
 	TxnStateActive     TxnState = "Active"
 	TxnStateAutoCommit TxnState = "AutoCommit"
+	// TxnStateFail is the transaction aborted by a failed statement, it must be rolled back.
+	TxnStateFail TxnState = "Fail"
 )
 
 type SessionState struct {
@@ -104,7 +168,7 @@ type SessionState struct {
 	Settings map[string]string `json:"settings,omitempty"`
 
 	// txn
-	TxnState TxnState `json:"txn_state,omitempty"` // "Active", "AutoCommit"
+	TxnState TxnState `json:"txn_state,omitempty"` // "Active", "AutoCommit", "Fail"
 }
 
 type StageAttachmentConfig struct {
@@ -0,0 +1,62 @@
+package godatabend
+
+import (
+	"context"
+	"time"
+)
+
+type (
+	contextKeySettings     struct{}
+	contextKeyPagination   struct{}
+	contextKeyQueryTimeout struct{}
+)
+
+// WithSettings returns a context whose queries run with the settings merged into the
+// session of the connection, the session is not changed by them. The settings of an outer
+// WithSettings are kept unless overridden.
+func WithSettings(ctx context.Context, settings map[string]string) context.Context {
+	merged := map[string]string{}
+	for k, v := range contextSettings(ctx) {
+		merged[k] = v
+	}
+	for k, v := range settings {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, contextKeySettings{}, merged)
+}
+
+func contextSettings(ctx context.Context) map[string]string {
+	settings, _ := ctx.Value(contextKeySettings{}).(map[string]string)
+	return settings
+}
+
+// WithPagination returns a context whose queries are paged by the non-zero fields of the
+// config instead of the ones of the connection.
+func WithPagination(ctx context.Context, cfg PaginationConfig) context.Context {
+	if outer, ok := ctx.Value(contextKeyPagination{}).(PaginationConfig); ok {
+		cfg = mergePagination(outer, cfg)
+	}
+	return context.WithValue(ctx, contextKeyPagination{}, cfg)
+}
+
+// mergePagination returns the config with the zero fields taken from the base.
+func mergePagination(base, cfg PaginationConfig) PaginationConfig {
+	if cfg.WaitTime == 0 {
+		cfg.WaitTime = base.WaitTime
+	}
+	if cfg.MaxRowsInBuffer == 0 {
+		cfg.MaxRowsInBuffer = base.MaxRowsInBuffer
+	}
+	if cfg.MaxRowsPerPage == 0 {
+		cfg.MaxRowsPerPage = base.MaxRowsPerPage
+	}
+	return cfg
+}
+
+// WithQueryTimeout returns a context whose queries are killed by the server once they run
+// longer than d. Unlike context.WithTimeout the context is not canceled, so the result of
+// a finished query can be read without the limit. The shortest of d, the deadline of the
+// context and the max_execute_time_in_seconds of WithSettings or the session applies.
+func WithQueryTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, contextKeyQueryTimeout{}, d)
+}
@@ -0,0 +1,129 @@
+package godatabend
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithSettings(t *testing.T) {
+	var gotSession map[string]interface{}
+	c := NewAPIClientFromConfig(&Config{User: "root", Params: map[string]string{"max_threads": "4", "timezone": "UTC"}})
+	c.doRequestFunc = func(method, path string, req interface{}, resp interface{}) error {
+		request := req.(*QueryRequest)
+		gotSession = nil
+		_ = json.Unmarshal(*request.Session, &gotSession)
+		result := QueryResponse{ID: "q1", State: "Succeeded", Session: request.Session}
+		buf, _ := json.Marshal(result)
+		return json.Unmarshal(buf, resp)
+	}
+
+	ctx := WithSettings(context.Background(), map[string]string{"max_threads": "1", "enable_query_result_cache": "1"})
+	ctx = WithSettings(ctx, map[string]string{"enable_query_result_cache": "0"})
+	_, err := c.StartQuery(ctx, "SELECT 1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"max_threads": "1", "timezone": "UTC", "enable_query_result_cache": "0"},
+		gotSession["settings"])
+
+	// the session of the connection is not changed
+	assert.Equal(t, map[string]string{"max_threads": "4", "timezone": "UTC"}, c.getSessionState().Settings)
+	_, err = c.StartQuery(context.Background(), "SELECT 1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"max_threads": "4", "timezone": "UTC"}, gotSession["settings"])
+}
+
+func TestWithPagination(t *testing.T) {
+	var gotPagination *PaginationConfig
+	c := NewAPIClientFromConfig(&Config{User: "root", WaitTimeSecs: 10, MaxRowsPerPage: 1000})
+	c.doRequestFunc = func(method, path string, req interface{}, resp interface{}) error {
+		gotPagination = req.(*QueryRequest).Pagination
+		return json.Unmarshal([]byte(`{"id":"q1","state":"Succeeded"}`), resp)
+	}
+
+	ctx := WithPagination(context.Background(), PaginationConfig{MaxRowsPerPage: 10})
+	ctx = WithPagination(ctx, PaginationConfig{MaxRowsInBuffer: 100})
+	_, err := c.StartQuery(ctx, "SELECT 1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, &PaginationConfig{WaitTime: 10, MaxRowsPerPage: 10, MaxRowsInBuffer: 100}, gotPagination)
+
+	_, err = c.StartQuery(context.Background(), "SELECT 1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, &PaginationConfig{WaitTime: 10, MaxRowsPerPage: 1000}, gotPagination)
+}
+
+func TestWithQueryTimeout(t *testing.T) {
+	var gotSession map[string]interface{}
+	c := NewAPIClientFromConfig(&Config{User: "root"})
+	c.doRequestFunc = func(method, path string, req interface{}, resp interface{}) error {
+		gotSession = nil
+		_ = json.Unmarshal(*req.(*QueryRequest).Session, &gotSession)
+		return json.Unmarshal([]byte(`{"id":"q1","state":"Succeeded"}`), resp)
+	}
+
+	ctx := WithQueryTimeout(context.Background(), 1500*time.Millisecond)
+	_, err := c.StartQuery(ctx, "SELECT 1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{MAX_EXECUTE_TIME_IN_SECONDS: "2"}, gotSession["settings"])
+	assert.NoError(t, ctx.Err())
+
+	// the deadline of the context applies if it's shorter
+	ctx, cancel := context.WithTimeout(WithQueryTimeout(context.Background(), time.Hour), 30*time.Second)
+	defer cancel()
+	_, err = c.StartQuery(ctx, "SELECT 1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{MAX_EXECUTE_TIME_IN_SECONDS: "30"}, gotSession["settings"])
+}
+
+func TestQueryTimeoutKeepsShorterSetting(t *testing.T) {
+	var gotSession map[string]interface{}
+	c := NewAPIClientFromConfig(&Config{User: "root", Params: map[string]string{MAX_EXECUTE_TIME_IN_SECONDS: "5"}})
+	// setValue is set by the query, the server echoes the session of the request otherwise
+	var setValue string
+	c.doRequestFunc = func(method, path string, req interface{}, resp interface{}) error {
+		request := req.(*QueryRequest)
+		gotSession = nil
+		_ = json.Unmarshal(*request.Session, &gotSession)
+		session := request.Session
+		if setValue != "" {
+			session, _ = rewriteSessionSettings(session, func(settings map[string]string) {
+				settings[MAX_EXECUTE_TIME_IN_SECONDS] = setValue
+			})
+		}
+		result := QueryResponse{ID: "q1", State: "Succeeded", Session: session}
+		buf, _ := json.Marshal(result)
+		return json.Unmarshal(buf, resp)
+	}
+	limit := func() interface{} {
+		return gotSession["settings"].(map[string]interface{})[MAX_EXECUTE_TIME_IN_SECONDS]
+	}
+
+	// the limit of the session is shorter than the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := c.StartQuery(ctx, "SELECT 1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "5", limit())
+
+	// the ones of WithSettings are kept if shorter, and limited by the deadline otherwise
+	_, err = c.StartQuery(WithSettings(ctx, map[string]string{MAX_EXECUTE_TIME_IN_SECONDS: "100"}), "SELECT 1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "30", limit())
+	_, err = c.StartQuery(WithQueryTimeout(WithSettings(ctx, map[string]string{MAX_EXECUTE_TIME_IN_SECONDS: "3"}), time.Hour), "SELECT 1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "3", limit())
+	_, err = c.StartQuery(WithSettings(ctx, map[string]string{MAX_EXECUTE_TIME_IN_SECONDS: "0"}), "SELECT 1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "30", limit())
+	assert.Equal(t, "5", c.getSessionState().Settings[MAX_EXECUTE_TIME_IN_SECONDS])
+
+	// a SET run under the deadline changes the session
+	setValue = "60"
+	_, err = c.StartQuery(ctx, "SET max_execute_time_in_seconds = 60", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "60", c.getSessionState().Settings[MAX_EXECUTE_TIME_IN_SECONDS])
+	assert.Contains(t, string(*c.getSessionStateRaw()), `"60"`)
+}
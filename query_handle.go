@@ -0,0 +1,174 @@
+package godatabend
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// contextKeyRouteHint overrides the route hint of the client for the requests of a
+// query handle, so they reach the node running the query.
+const contextKeyRouteHint ContextKey = "ROUTE-HINT"
+
+// contextKeyNodeID overrides the node id of the client for the requests of a query
+// handle, which may be attached by a client which never ran a query on that node.
+const contextKeyNodeID ContextKey = "NODE-ID"
+
+// QueryHandle identifies a query started by Submit, which keeps running on the server
+// without a goroutine or a connection waiting for it. The handle can be serialized by
+// encoding/json and used by another client, even in another process, to poll the query,
+// wait for it and fetch its result, or kill it.
+type QueryHandle struct {
+	QueryID   string           `json:"query_id"`
+	NodeID    string           `json:"node_id"`
+	RouteHint string           `json:"route_hint,omitempty"`
+	NextURI   string           `json:"next_uri"`
+	KillURI   string           `json:"kill_uri"`
+	FinalURI  string           `json:"final_uri"`
+	State     string           `json:"state"`
+	Session   *json.RawMessage `json:"session,omitempty"`
+	Stats     *QueryStats      `json:"stats,omitempty"`
+	// Schema and Data are the result received so far, the pages are only served once by
+	// the server, so they are kept in the handle until the result is fetched.
+	Schema *[]DataField `json:"schema,omitempty"`
+	Data   [][]*string  `json:"data,omitempty"`
+}
+
+// Finished reports whether the query has finished on the server.
+func (h *QueryHandle) Finished() bool {
+	return h.NextURI == "" || h.NextURI == h.FinalURI
+}
+
+func (h *QueryHandle) update(resp *QueryResponse) {
+	h.NextURI = resp.NextURI
+	if resp.KillURI != "" {
+		h.KillURI = resp.KillURI
+	}
+	if resp.FinalURI != "" {
+		h.FinalURI = resp.FinalURI
+	}
+	if resp.ReadFinished() {
+		h.NextURI = h.FinalURI
+	}
+	h.State = resp.State
+	if resp.Session != nil {
+		h.Session = resp.Session
+	}
+	if resp.Stats != nil {
+		h.Stats = resp.Stats
+	}
+	if resp.Schema != nil && len(*resp.Schema) > 0 {
+		h.Schema = resp.Schema
+	}
+	h.Data = append(h.Data, resp.Data...)
+}
+
+// context returns the context of the requests of the query, carrying its query id, node
+// id and route hint.
+func (h *QueryHandle) context(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, ContextKeyQueryID, h.QueryID)
+	if h.NodeID != "" {
+		ctx = context.WithValue(ctx, contextKeyNodeID, h.NodeID)
+	}
+	if h.RouteHint != "" {
+		ctx = context.WithValue(ctx, contextKeyRouteHint, h.RouteHint)
+	}
+	return ctx
+}
+
+// Submit starts the query and returns its handle without waiting for it to finish. The
+// deadline of the context only limits the submit request, the query is not limited by it
+// as the other queries are, its execution time on the server could be limited by
+// WithQueryTimeout.
+func (c *APIClient) Submit(ctx context.Context, sql string) (*QueryHandle, error) {
+	ctx = c.checkQueryID(ctx)
+	session, err := c.makeSessionStateRaw(noDeadlineContext{ctx})
+	if err != nil {
+		return nil, err
+	}
+	request := QueryRequest{
+		SQL:        sql,
+		Pagination: c.getPagenationConfig(ctx),
+		Session:    session,
+	}
+	resp, err := c.startQueryRequest(ctx, &request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		_ = c.CloseQuery(ctx, resp)
+		return nil, errors.Wrap(resp.Error, "query error")
+	}
+	h := &QueryHandle{
+		QueryID:   resp.ID,
+		NodeID:    resp.NodeID,
+		RouteHint: c.routeHint,
+	}
+	h.update(resp)
+	return h, nil
+}
+
+// PollQueryHandle polls the query of the handle once, the rows received are kept in the
+// handle. It returns the error of the query if it failed. The session of the query is
+// kept in the handle, the one of the client is not changed.
+func (c *APIClient) PollQueryHandle(ctx context.Context, h *QueryHandle) error {
+	if h.Finished() {
+		return nil
+	}
+	resp, err := c.pollPage(h.context(ctx), h.NextURI)
+	if err != nil {
+		return errors.Wrap(err, "failed to query page")
+	}
+	h.update(resp)
+	if resp.Error != nil {
+		return errors.Wrap(resp.Error, "query error")
+	}
+	return nil
+}
+
+// WaitQueryHandle polls the query of the handle until it finishes, and returns the
+// whole result. The query is finalized on the server then, so the result could be
+// fetched only once. The query keeps running if the context is done before it finishes.
+func (c *APIClient) WaitQueryHandle(ctx context.Context, h *QueryHandle) (*QueryResponse, error) {
+	for !h.Finished() {
+		if err := c.PollQueryHandle(ctx, h); err != nil {
+			if h.Finished() {
+				_ = c.CloseQuery(h.context(ctx), &QueryResponse{FinalURI: h.FinalURI})
+			}
+			return nil, err
+		}
+	}
+	resp := &QueryResponse{
+		ID:       h.QueryID,
+		NodeID:   h.NodeID,
+		Session:  h.Session,
+		Schema:   h.Schema,
+		Data:     h.Data,
+		State:    h.State,
+		Stats:    h.Stats,
+		FinalURI: h.FinalURI,
+		KillURI:  h.KillURI,
+	}
+	if err := c.CloseQuery(h.context(ctx), resp); err != nil {
+		return nil, err
+	}
+	h.Data = nil
+	return resp, nil
+}
+
+// KillQueryHandle kills the query of the handle.
+func (c *APIClient) KillQueryHandle(ctx context.Context, h *QueryHandle) error {
+	return c.KillQuery(h.context(ctx), &QueryResponse{ID: h.QueryID, KillURI: h.KillURI})
+}
+
+// noDeadlineContext hides the deadline of the context from the query settings, it's still
+// canceled at the deadline.
+type noDeadlineContext struct {
+	context.Context
+}
+
+func (noDeadlineContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
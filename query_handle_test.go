@@ -0,0 +1,137 @@
+package godatabend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryHandleAttach(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		return strings.Replace(runningQuery, `"id":"q1",`, `"id":"q1","node_id":"node-1",`, 1)
+	}
+	var (
+		mu      sync.Mutex
+		headers []http.Header
+	)
+	srv.onPage = func(r *http.Request) string {
+		mu.Lock()
+		headers = append(headers, r.Header.Clone())
+		mu.Unlock()
+		if r.URL.Path == "/v1/query/q1/page/1" {
+			return `{"id":"q1","state":"Succeeded","data":[["2"]],
+"next_uri":"/v1/query/q1/final","final_uri":"/v1/query/q1/final","kill_uri":"/v1/query/q1/kill"}`
+		}
+		return `{"id":"q1","state":"Succeeded"}`
+	}
+
+	h, err := newTestConn(t, srv.URL).rest.Submit(context.Background(), "INSERT INTO t SELECT * FROM s")
+	require.NoError(t, err)
+	assert.Equal(t, "q1", h.QueryID)
+	assert.Equal(t, "node-1", h.NodeID)
+	assert.False(t, h.Finished())
+	buf, err := json.Marshal(h)
+	require.NoError(t, err)
+
+	// another client attaches to the query by the serialized handle, its requests go to
+	// the node of the query, not the one of its own last query
+	var attached QueryHandle
+	require.NoError(t, json.Unmarshal(buf, &attached))
+	attached.RouteHint = "hint-1"
+	other := newTestConn(t, srv.URL).rest
+	other.NodeID = "node-2"
+	resp, err := other.WaitQueryHandle(context.Background(), &attached)
+	require.NoError(t, err)
+	assert.True(t, attached.Finished())
+	assert.Equal(t, "Succeeded", resp.State)
+	require.Len(t, resp.Data, 2)
+	assert.Equal(t, "1", *resp.Data[0][0])
+	assert.Equal(t, "2", *resp.Data[1][0])
+	assert.Equal(t, []DataField{{Name: "n", Type: "Int64"}}, *resp.Schema)
+
+	assert.Equal(t, []string{"/v1/query/q1/page/1", "/v1/query/q1/final"}, srv.requestedPages())
+	for _, header := range headers {
+		assert.Equal(t, "q1", header.Get(DatabendQueryIDHeader))
+		assert.Equal(t, "hint-1", header.Get(DatabendRouteHintHeader))
+		assert.Equal(t, "node-1", header.Get(DatabendQueryIDNode))
+	}
+}
+
+func TestQueryHandleKill(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string { return runningQuery }
+
+	c := newTestConn(t, srv.URL).rest
+	h, err := c.Submit(context.Background(), "INSERT INTO t SELECT * FROM s")
+	require.NoError(t, err)
+	require.NoError(t, c.KillQueryHandle(context.Background(), h))
+	assert.Equal(t, []string{"/v1/query/q1/kill"}, srv.requestedPages())
+}
+
+func TestQueryHandleError(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string { return runningQuery }
+	srv.onPage = func(r *http.Request) string {
+		return `{"id":"q1","state":"Failed","error":{"code":1006,"message":"divided by zero"},
+"next_uri":"/v1/query/q1/final","final_uri":"/v1/query/q1/final"}`
+	}
+
+	c := newTestConn(t, srv.URL).rest
+	h, err := c.Submit(context.Background(), "INSERT INTO t SELECT 1 / 0")
+	require.NoError(t, err)
+	_, err = c.WaitQueryHandle(context.Background(), h)
+	assert.ErrorContains(t, err, "divided by zero")
+	assert.True(t, h.Finished())
+	assert.Equal(t, "Failed", h.State)
+	assert.Equal(t, []string{"/v1/query/q1/page/1", "/v1/query/q1/final"}, srv.requestedPages())
+}
+
+func TestQueryHandleKeepsClientSession(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string { return runningQuery }
+	srv.onPage = func(r *http.Request) string {
+		return `{"id":"q1","state":"Succeeded","session":{"database":"etl_db","txn_state":"Active"},
+"next_uri":"/v1/query/q1/final","final_uri":"/v1/query/q1/final"}`
+	}
+
+	h, err := newTestConn(t, srv.URL).rest.Submit(context.Background(), "INSERT INTO t SELECT * FROM s")
+	require.NoError(t, err)
+
+	c := newTestConn(t, srv.URL).rest
+	require.NoError(t, c.updateSessionField("database", "mine"))
+	resp, err := c.WaitQueryHandle(context.Background(), h)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"database":"etl_db","txn_state":"Active"}`, string(*resp.Session))
+	assert.Equal(t, "mine", c.getSessionState().Database)
+	assert.False(t, c.inActiveTransaction())
+}
+
+func TestSubmitWithoutDeadlineSetting(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string { return runningQuery }
+
+	c := newTestConn(t, srv.URL).rest
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := c.Submit(ctx, "INSERT INTO t SELECT * FROM s")
+	require.NoError(t, err)
+	_, err = c.Submit(WithQueryTimeout(ctx, time.Hour), "INSERT INTO t SELECT * FROM s")
+	require.NoError(t, err)
+
+	require.Len(t, srv.queries, 2)
+	assert.NotContains(t, string(*srv.queries[0].Session), MAX_EXECUTE_TIME_IN_SECONDS)
+	assert.Contains(t, string(*srv.queries[1].Session), `"`+MAX_EXECUTE_TIME_IN_SECONDS+`":"3600"`)
+}
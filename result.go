@@ -1,6 +1,9 @@
 package godatabend
 
-import "database/sql/driver"
+import (
+	"database/sql/driver"
+	"time"
+)
 
 var emptyResult driver.Result = noResult{}
 
@@ -13,3 +16,82 @@ func (noResult) LastInsertId() (int64, error) {
 func (noResult) RowsAffected() (int64, error) {
 	return 0, nil
 }
+
+// QueryInfo describes the query run by the driver, it's implemented by the driver.Result
+// of DatabendConn.ExecContext and the driver.Rows of DatabendConn.QueryContext, which are
+// reachable by sql.Conn.Raw:
+//
+//	err := conn.Raw(func(driverConn interface{}) error {
+//		result, err := driverConn.(driver.ExecerContext).ExecContext(ctx, "INSERT INTO t VALUES (1)", nil)
+//		if err != nil {
+//			return err
+//		}
+//		info := result.(godatabend.QueryInfo)
+//		log.Println(info.QueryID(), info.Elapsed())
+//		return nil
+//	})
+type QueryInfo interface {
+	// QueryID is the id of the query on the server.
+	QueryID() string
+	// NodeID is the id of the node running the query.
+	NodeID() string
+	// Stats are the latest stats of the query, they are final once the query has finished
+	// or all the rows have been read. It's nil if the server has not responded any.
+	Stats() *QueryStats
+	// Elapsed is the time from the query being started to its end, or to now if it's
+	// still running.
+	Elapsed() time.Duration
+}
+
+// queryInfo records the QueryInfo of a query from its responses.
+type queryInfo struct {
+	queryID string
+	nodeID  string
+	stats   *QueryStats
+	start   time.Time
+	end     time.Time
+}
+
+// track updates the info by a response of the query.
+func (i *queryInfo) track(resp *QueryResponse) {
+	if resp == nil {
+		return
+	}
+	if resp.ID != "" {
+		i.queryID = resp.ID
+	}
+	if resp.NodeID != "" {
+		i.nodeID = resp.NodeID
+	}
+	if resp.Stats != nil {
+		i.stats = resp.Stats
+	}
+	if resp.ReadFinished() && i.end.IsZero() {
+		i.end = time.Now()
+	}
+}
+
+func (i *queryInfo) QueryID() string {
+	return i.queryID
+}
+
+func (i *queryInfo) NodeID() string {
+	return i.nodeID
+}
+
+func (i *queryInfo) Stats() *QueryStats {
+	return i.stats
+}
+
+func (i *queryInfo) Elapsed() time.Duration {
+	if i.end.IsZero() {
+		return time.Since(i.start)
+	}
+	return i.end.Sub(i.start)
+}
+
+// execResult is the result of DatabendConn.ExecContext.
+type execResult struct {
+	noResult
+	queryInfo
+}
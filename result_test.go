@@ -0,0 +1,74 @@
+package godatabend
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecQueryInfo(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		return `{"id":"q1","node_id":"n1","state":"Succeeded","stats":{"write_progress":{"rows":3,"bytes":24}}}`
+	}
+
+	conn, err := openTestDB(t, srv.URL).Conn(context.Background())
+	require.NoError(t, err)
+	defer conn.Close()
+	err = conn.Raw(func(driverConn interface{}) error {
+		result, err := driverConn.(driver.ExecerContext).ExecContext(context.Background(), "INSERT INTO t VALUES (1), (2), (3)", nil)
+		if err != nil {
+			return err
+		}
+		info, ok := result.(QueryInfo)
+		require.True(t, ok)
+		assert.Equal(t, "q1", info.QueryID())
+		assert.Equal(t, "n1", info.NodeID())
+		assert.Equal(t, uint64(3), info.Stats().WriteProgress.Rows)
+		elapsed := info.Elapsed()
+		assert.Greater(t, elapsed, time.Duration(0))
+		assert.Equal(t, elapsed, info.Elapsed())
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestRowsQueryInfo(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string { return runningQuery }
+	srv.onPage = func(r *http.Request) string {
+		return `{"id":"q1","node_id":"n1","state":"Succeeded","next_uri":"/v1/query/q1/final",
+"stats":{"result_progress":{"rows":2,"bytes":16}},"data":[["2"]]}`
+	}
+
+	conn, err := openTestDB(t, srv.URL).Conn(context.Background())
+	require.NoError(t, err)
+	defer conn.Close()
+	err = conn.Raw(func(driverConn interface{}) error {
+		rows, err := driverConn.(driver.QueryerContext).QueryContext(context.Background(), "SELECT * FROM t", nil)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		info := rows.(QueryInfo)
+		assert.Equal(t, "q1", info.QueryID())
+		assert.Nil(t, info.Stats())
+
+		dest := make([]driver.Value, 1)
+		for rows.Next(dest) == nil {
+		}
+		assert.Equal(t, "n1", info.NodeID())
+		assert.Equal(t, uint64(2), info.Stats().ResultProgress.Rows)
+		elapsed := info.Elapsed()
+		assert.Equal(t, elapsed, info.Elapsed())
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,383 @@
+package godatabend
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ResultFormat is the output format of WriteRows.
+type ResultFormat string
+
+const (
+	ResultFormatCSV      ResultFormat = "csv"
+	ResultFormatTSV      ResultFormat = "tsv"
+	ResultFormatJSON     ResultFormat = "json"
+	ResultFormatNDJSON   ResultFormat = "ndjson"
+	ResultFormatMarkdown ResultFormat = "markdown"
+)
+
+// resultColumn is a column of the written rows, the values are rendered by the type.
+type resultColumn struct {
+	name string
+	// typ is the name of the type without nullable, like Timestamp, Decimal or Array
+	typ string
+}
+
+func newResultColumns(rows *sql.Rows) ([]resultColumn, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]resultColumn, len(types))
+	for i, t := range types {
+		columns[i] = resultColumn{name: t.Name()}
+		desc, err := ParseTypeDesc(t.DatabaseTypeName())
+		if err != nil {
+			return nil, err
+		}
+		if desc.Name == "Nullable" && len(desc.Args) > 0 {
+			desc = desc.Args[0]
+		}
+		columns[i].typ = desc.Name
+	}
+	return columns, nil
+}
+
+func (c resultColumn) isNested() bool {
+	switch c.typ {
+	case "Array", "Map", "Tuple", "Variant", "VariantObject", "VariantArray":
+		return true
+	}
+	return false
+}
+
+// text renders a non-null value as text, the nested values are rendered as JSON.
+func (c resultColumn) text(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case time.Time:
+		if c.typ == "Date" {
+			return v.Format(dateFormat), nil
+		}
+		return v.Format(dateTime64Format), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case int8, int16, int32, int64, int, uint8, uint16, uint32, uint64, uint:
+		return formatInteger(v), nil
+	}
+	data, err := c.json(v)
+	return string(data), err
+}
+
+func formatInteger(v interface{}) string {
+	switch v := v.(type) {
+	case int8:
+		return strconv.FormatInt(int64(v), 10)
+	case int16:
+		return strconv.FormatInt(int64(v), 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int:
+		return strconv.FormatInt(int64(v), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	}
+	return ""
+}
+
+// json renders a value as JSON, the decimals are kept as exact numbers and the variants
+// are embedded as they are.
+func (c resultColumn) json(v interface{}) ([]byte, error) {
+	if v == nil {
+		return []byte("null"), nil
+	}
+	switch v := v.(type) {
+	case string:
+		if (c.typ == "Decimal" || c.isNested()) && json.Valid([]byte(v)) {
+			return []byte(v), nil
+		}
+		return json.Marshal(v)
+	case []byte:
+		return json.Marshal(string(v))
+	case time.Time:
+		text, _ := c.text(v)
+		return json.Marshal(text)
+	case float32:
+		return jsonFloat(float64(v), 32)
+	case float64:
+		return jsonFloat(v, 64)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal column %s failed", c.name)
+	}
+	return data, nil
+}
+
+// jsonFloat renders NaN and infinities as strings, which are not valid JSON numbers.
+func jsonFloat(v float64, bitSize int) ([]byte, error) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return json.Marshal(strconv.FormatFloat(v, 'g', -1, bitSize))
+	}
+	return []byte(strconv.FormatFloat(v, 'g', -1, bitSize)), nil
+}
+
+// WriteRows writes all the rows into w in the format and returns the number of rows
+// written. The values are rendered by the column types of the driver: NULL is an empty
+// field in CSV, \N in TSV, null in JSON and NULL in Markdown, the timestamps are written
+// in the server format, the decimals keep their exact digits, and the nested values are
+// written as JSON. The header is written in CSV, TSV and Markdown.
+func WriteRows(w io.Writer, rows *sql.Rows, format ResultFormat) (int64, error) {
+	columns, err := newResultColumns(rows)
+	if err != nil {
+		return 0, err
+	}
+	var rw resultWriter
+	bw := bufio.NewWriter(w)
+	switch format {
+	case ResultFormatCSV:
+		rw = &csvResultWriter{w: csv.NewWriter(bw), columns: columns}
+	case ResultFormatTSV:
+		rw = &tsvResultWriter{w: bw, columns: columns}
+	case ResultFormatJSON:
+		rw = &jsonResultWriter{w: bw, columns: columns, array: true}
+	case ResultFormatNDJSON:
+		rw = &jsonResultWriter{w: bw, columns: columns}
+	case ResultFormatMarkdown:
+		rw = &markdownResultWriter{w: bw, columns: columns}
+	default:
+		return 0, errors.Errorf("unsupported result format %q", string(format))
+	}
+
+	if err = rw.begin(); err != nil {
+		return 0, err
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var n int64
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		if err = rw.write(values); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err = rows.Err(); err != nil {
+		return n, err
+	}
+	if err = rw.end(); err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+type resultWriter interface {
+	begin() error
+	write(values []interface{}) error
+	end() error
+}
+
+type csvResultWriter struct {
+	w       *csv.Writer
+	columns []resultColumn
+	record  []string
+}
+
+func (r *csvResultWriter) begin() error {
+	r.record = make([]string, len(r.columns))
+	for i, c := range r.columns {
+		r.record[i] = c.name
+	}
+	return r.w.Write(r.record)
+}
+
+func (r *csvResultWriter) write(values []interface{}) error {
+	for i, v := range values {
+		r.record[i] = ""
+		if v == nil {
+			continue
+		}
+		text, err := r.columns[i].text(v)
+		if err != nil {
+			return err
+		}
+		r.record[i] = text
+	}
+	return r.w.Write(r.record)
+}
+
+func (r *csvResultWriter) end() error {
+	r.w.Flush()
+	return r.w.Error()
+}
+
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+type tsvResultWriter struct {
+	w       *bufio.Writer
+	columns []resultColumn
+}
+
+func (r *tsvResultWriter) begin() error {
+	for i, c := range r.columns {
+		if i > 0 {
+			_ = r.w.WriteByte('\t')
+		}
+		_, _ = tsvEscaper.WriteString(r.w, c.name)
+	}
+	return r.w.WriteByte('\n')
+}
+
+func (r *tsvResultWriter) write(values []interface{}) error {
+	for i, v := range values {
+		if i > 0 {
+			_ = r.w.WriteByte('\t')
+		}
+		if v == nil {
+			_, _ = r.w.WriteString(`\N`)
+			continue
+		}
+		text, err := r.columns[i].text(v)
+		if err != nil {
+			return err
+		}
+		if _, err = tsvEscaper.WriteString(r.w, text); err != nil {
+			return err
+		}
+	}
+	return r.w.WriteByte('\n')
+}
+
+func (r *tsvResultWriter) end() error {
+	return nil
+}
+
+type jsonResultWriter struct {
+	w       *bufio.Writer
+	columns []resultColumn
+	// array writes the rows as a JSON array, otherwise a JSON object per line
+	array bool
+	rows  int64
+	keys  [][]byte
+}
+
+func (r *jsonResultWriter) begin() error {
+	r.keys = make([][]byte, len(r.columns))
+	for i, c := range r.columns {
+		key, err := json.Marshal(c.name)
+		if err != nil {
+			return err
+		}
+		r.keys[i] = key
+	}
+	if r.array {
+		return r.w.WriteByte('[')
+	}
+	return nil
+}
+
+func (r *jsonResultWriter) write(values []interface{}) error {
+	if r.array && r.rows > 0 {
+		_ = r.w.WriteByte(',')
+	}
+	r.rows++
+	_ = r.w.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			_ = r.w.WriteByte(',')
+		}
+		data, err := r.columns[i].json(v)
+		if err != nil {
+			return err
+		}
+		_, _ = r.w.Write(r.keys[i])
+		_ = r.w.WriteByte(':')
+		if _, err = r.w.Write(data); err != nil {
+			return err
+		}
+	}
+	_ = r.w.WriteByte('}')
+	if !r.array {
+		return r.w.WriteByte('\n')
+	}
+	return nil
+}
+
+func (r *jsonResultWriter) end() error {
+	if r.array {
+		_, err := r.w.WriteString("]\n")
+		return err
+	}
+	return nil
+}
+
+var markdownEscaper = strings.NewReplacer(`|`, `\|`, "\r\n", "<br>", "\n", "<br>")
+
+type markdownResultWriter struct {
+	w       *bufio.Writer
+	columns []resultColumn
+}
+
+func (r *markdownResultWriter) begin() error {
+	_, _ = r.w.WriteString("|")
+	for _, c := range r.columns {
+		_, _ = r.w.WriteString(" " + markdownEscaper.Replace(c.name) + " |")
+	}
+	_, _ = r.w.WriteString("\n|")
+	for range r.columns {
+		_, _ = r.w.WriteString(" --- |")
+	}
+	return r.w.WriteByte('\n')
+}
+
+func (r *markdownResultWriter) write(values []interface{}) error {
+	_, _ = r.w.WriteString("|")
+	for i, v := range values {
+		text := "NULL"
+		if v != nil {
+			var err error
+			if text, err = r.columns[i].text(v); err != nil {
+				return err
+			}
+		}
+		if _, err := r.w.WriteString(" " + markdownEscaper.Replace(text) + " |"); err != nil {
+			return err
+		}
+	}
+	return r.w.WriteByte('\n')
+}
+
+func (r *markdownResultWriter) end() error {
+	return nil
+}
@@ -0,0 +1,78 @@
+package godatabend
+
+import (
+	"bytes"
+	"database/sql"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func queryTestRows(t *testing.T) (*sql.DB, *sql.Rows) {
+	srv := newTestServer(t)
+	t.Cleanup(srv.Close)
+	srv.onQuery = func(req QueryRequest) string {
+		return `{"id":"q1","state":"Succeeded",
+"schema":[{"name":"id","type":"Int32"},{"name":"name","type":"Nullable(String)"},
+{"name":"price","type":"Nullable(Decimal(10, 2))"},{"name":"day","type":"Date"},
+{"name":"ts","type":"Timestamp"},{"name":"tags","type":"Array(Int64)"},{"name":"v","type":"Nullable(Variant)"}],
+"data":[["1","a|b","12.50","2024-01-02","2024-01-02 03:04:05.000000","[1,2]","{\"k\":1}"],
+["2",null,"NULL","2024-01-03","2024-01-03 00:00:00.500000","[]","NULL"]]}`
+	}
+	db := openTestDB(t, srv.URL)
+	rows, err := db.Query("SELECT * FROM t")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = rows.Close() })
+	return db, rows
+}
+
+func TestWriteRows(t *testing.T) {
+	expects := map[ResultFormat]string{
+		ResultFormatCSV: `id,name,price,day,ts,tags,v
+1,a|b,12.50,2024-01-02,2024-01-02 03:04:05,"[1,2]","{""k"":1}"
+2,,,2024-01-03,2024-01-03 00:00:00.5,[],
+`,
+		ResultFormatTSV: "id\tname\tprice\tday\tts\ttags\tv\n" +
+			"1\ta|b\t12.50\t2024-01-02\t2024-01-02 03:04:05\t[1,2]\t{\"k\":1}\n" +
+			"2\t\\N\t\\N\t2024-01-03\t2024-01-03 00:00:00.5\t[]\t\\N\n",
+		ResultFormatJSON: `[{"id":1,"name":"a|b","price":12.50,"day":"2024-01-02","ts":"2024-01-02 03:04:05","tags":[1,2],"v":{"k":1}},` +
+			`{"id":2,"name":null,"price":null,"day":"2024-01-03","ts":"2024-01-03 00:00:00.5","tags":[],"v":null}]
+`,
+		ResultFormatNDJSON: `{"id":1,"name":"a|b","price":12.50,"day":"2024-01-02","ts":"2024-01-02 03:04:05","tags":[1,2],"v":{"k":1}}
+{"id":2,"name":null,"price":null,"day":"2024-01-03","ts":"2024-01-03 00:00:00.5","tags":[],"v":null}
+`,
+		ResultFormatMarkdown: `| id | name | price | day | ts | tags | v |
+| --- | --- | --- | --- | --- | --- | --- |
+| 1 | a\|b | 12.50 | 2024-01-02 | 2024-01-02 03:04:05 | [1,2] | {"k":1} |
+| 2 | NULL | NULL | 2024-01-03 | 2024-01-03 00:00:00.5 | [] | NULL |
+`,
+	}
+	for format, expect := range expects {
+		t.Run(string(format), func(t *testing.T) {
+			_, rows := queryTestRows(t)
+			var buf bytes.Buffer
+			n, err := WriteRows(&buf, rows, format)
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), n)
+			assert.Equal(t, expect, buf.String())
+		})
+	}
+}
+
+func TestWriteRowsUnsupportedFormat(t *testing.T) {
+	_, rows := queryTestRows(t)
+	_, err := WriteRows(&bytes.Buffer{}, rows, "xml")
+	assert.Error(t, err)
+}
+
+func TestResultColumnJSONFloat(t *testing.T) {
+	c := resultColumn{name: "f", typ: "Float64"}
+	data, err := c.json(1.5)
+	require.NoError(t, err)
+	assert.Equal(t, "1.5", string(data))
+	data, err = c.json(math.Inf(1))
+	require.NoError(t, err)
+	assert.Equal(t, `"+Inf"`, string(data))
+}
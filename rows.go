@@ -3,12 +3,12 @@ package godatabend
 import (
 	"context"
 	"database/sql/driver"
-	"errors"
 	"fmt"
 	"io"
 	"reflect"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 type resultSchema struct {
@@ -19,6 +19,7 @@ type resultSchema struct {
 
 type nextRows struct {
 	resultSchema
+	queryInfo
 	isClosed   int32
 	isCanceled bool
 	dc         *DatabendConn
@@ -30,23 +31,22 @@ func waitForData(ctx context.Context, dc *DatabendConn, response *QueryResponse)
 	if response.Error != nil {
 		return nil, response.Error
 	}
-	var err error
 	for !response.ReadFinished() && len(response.Data) == 0 && response.Error == nil {
-		response, err = dc.rest.PollQuery(ctx, response.NextURI)
+		next, err := dc.rest.PollQuery(ctx, response.NextURI)
 		if err != nil {
-			if errors.Is(err, context.Canceled) {
-				// context might be canceled due to timeout or canceled. if it's canceled, we need call
-				// the kill url to tell the backend it's killed.
-				dc.log("query canceled", response.ID)
+			if isContextError(ctx, err) {
+				// the query is still running on the server, kill it by the last response
+				dc.log("query canceled, kill query", response.ID)
 				_ = dc.rest.KillQuery(context.Background(), response)
 			} else {
 				_ = dc.rest.CloseQuery(ctx, response)
 			}
 			return nil, err
 		}
+		response = next
 		if response.Error != nil {
 			_ = dc.rest.CloseQuery(ctx, response)
-			return nil, fmt.Errorf("query error: %+v", response.Error)
+			return nil, fmt.Errorf("query error: %w", response.Error)
 		}
 	}
 	return response, nil
@@ -95,7 +95,9 @@ func newNextRows(ctx context.Context, dc *DatabendConn, resp *QueryResponse) (*n
 		ctx:          ctx,
 		respData:     resp,
 		resultSchema: *schema,
+		queryInfo:    queryInfo{start: time.Now()},
 	}
+	rows.track(resp)
 	return rows, nil
 }
 
@@ -111,7 +113,14 @@ func (r *nextRows) Columns() []string {
 // Note it will also be Called by framework when:
 //  1. Canceling query/txn Context.
 //  2. Next return error other than io.EOF.
+//
+// The query is killed if the rows are closed before EOF, the rest of the result is
+// not going to be read.
 func (r *nextRows) Close() error {
+	if atomic.LoadInt32(&r.isClosed) == 0 && r.respData != nil && !r.respData.ReadFinished() {
+		r.dc.log("rows closed before EOF, kill query", r.respData.ID)
+		_ = r.dc.rest.KillQuery(context.Background(), r.respData)
+	}
 	return r.doClose()
 }
 
@@ -145,6 +154,7 @@ func (r *nextRows) Next(dest []driver.Value) error {
 		if err != nil {
 			return err
 		}
+		r.track(r.respData)
 	}
 
 	if len(r.respData.Data) == 0 {
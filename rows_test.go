@@ -4,8 +4,10 @@ import (
 	"context"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTextRows(t *testing.T) {
@@ -35,3 +37,35 @@ func TestTextRows(t *testing.T) {
 func strPtr(s string) *string {
 	return &s
 }
+
+func TestRowsKilledOnEarlyClose(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string { return runningQuery }
+	srv.onPage = blockPages
+
+	db := openTestDB(t, srv.URL)
+	rows, err := db.Query("SELECT * FROM numbers(100000000)")
+	require.NoError(t, err)
+	require.True(t, rows.Next())
+	require.NoError(t, rows.Close())
+	assert.Equal(t, []string{"/v1/query/q1/kill", "/v1/query/q1/final"}, srv.requestedPages())
+}
+
+func TestRowsKilledOnDeadline(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string { return runningQuery }
+	srv.onPage = blockPages
+
+	db := openTestDB(t, srv.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT * FROM numbers(100000000)")
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+	}
+	assert.Error(t, rows.Err())
+	assert.Contains(t, srv.requestedPages(), "/v1/query/q1/kill")
+}
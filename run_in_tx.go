@@ -0,0 +1,108 @@
+package godatabend
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/avast/retry-go"
+)
+
+// retryableTxnErrorCodes are the codes of the query errors of a transaction which may
+// succeed if the transaction is run again.
+var retryableTxnErrorCodes = map[int]bool{
+	// TableVersionMismatched, the table is changed by a concurrent transaction
+	2009: true,
+	// UnresolvableConflict, the commit conflicts with a concurrent one
+	4001: true,
+}
+
+// RunInTxOptions are the options of RunInTx, the zero values take the defaults.
+type RunInTxOptions struct {
+	TxOptions *sql.TxOptions
+	// MaxAttempts is the number of times the transaction is run at most, 3 by default.
+	MaxAttempts uint
+	// Backoff is the delay before the first retry, it's doubled for every retry after, up
+	// to MaxBackoff. They are 100ms and 2s by default.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// IsRetryable reports whether the transaction failed with the error should be run
+	// again, IsRetryableTxnError by default.
+	IsRetryable func(err error) bool
+}
+
+// IsRetryableTxnError reports whether the error of a transaction is caused by a conflict
+// with a concurrent transaction, or by the warehouse being temporarily unavailable, so the
+// transaction may succeed if it's run again.
+func IsRetryableTxnError(err error) bool {
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		return retryableTxnErrorCodes[queryErr.Code]
+	}
+	var apiErr APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusServiceUnavailable || apiErr.RespBody.Error == ProvisionWarehouseTimeout
+	}
+	return strings.Contains(err.Error(), ProvisionWarehouseTimeout)
+}
+
+// RunInTx runs fn in a transaction and commits it, the transaction is run again with
+// backoff if it failed with a retryable error. The transaction is always rolled back if fn
+// returns an error or panics, and fn must not commit or roll it back itself. The error of
+// the last attempt is returned.
+func RunInTx(ctx context.Context, db *sql.DB, opts *RunInTxOptions, fn func(tx *sql.Tx) error) error {
+	if opts == nil {
+		opts = &RunInTxOptions{}
+	}
+	attempts, backoff, maxBackoff, isRetryable := opts.MaxAttempts, opts.Backoff, opts.MaxBackoff, opts.IsRetryable
+	if attempts == 0 {
+		attempts = 3
+	}
+	if backoff == 0 {
+		backoff = 100 * time.Millisecond
+	}
+	if maxBackoff == 0 {
+		maxBackoff = 2 * time.Second
+	}
+	if isRetryable == nil {
+		isRetryable = IsRetryableTxnError
+	}
+	return retry.Do(
+		func() error {
+			return runTx(ctx, db, opts.TxOptions, fn)
+		},
+		retry.RetryIf(func(err error) bool {
+			return ctx.Err() == nil && isRetryable(err)
+		}),
+		retry.Context(ctx),
+		retry.Attempts(attempts),
+		retry.Delay(backoff),
+		retry.MaxDelay(maxBackoff),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+	)
+}
+
+// runTx runs fn in a transaction once.
+func runTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
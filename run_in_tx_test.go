@@ -0,0 +1,107 @@
+package godatabend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conflictServer fails the first commits with a conflict, which ends the transaction.
+func conflictServer(t *testing.T, conflicts int) *testServer {
+	srv := newTestServer(t)
+	var mu sync.Mutex
+	srv.onQuery = func(req QueryRequest) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.SQL == "COMMIT" && conflicts > 0 {
+			conflicts--
+			buf, _ := json.Marshal(map[string]interface{}{"id": "q1", "state": "Failed",
+				"session": map[string]interface{}{"txn_state": TxnStateAutoCommit},
+				"error":   map[string]interface{}{"code": 4001, "message": "conflict on table t"}})
+			return string(buf)
+		}
+		return echoSession(req)
+	}
+	return srv
+}
+
+var testRunInTxOptions = &RunInTxOptions{Backoff: time.Millisecond}
+
+func TestRunInTxRetryConflict(t *testing.T) {
+	srv := conflictServer(t, 2)
+	defer srv.Close()
+	db := openTestDB(t, srv.URL)
+
+	runs := 0
+	err := RunInTx(context.Background(), db, testRunInTxOptions, func(tx *sql.Tx) error {
+		runs++
+		_, err := tx.Exec("INSERT INTO t VALUES (1)")
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, runs)
+	assert.Equal(t, []string{
+		"BEGIN", "INSERT INTO t VALUES (1)", "COMMIT",
+		"BEGIN", "INSERT INTO t VALUES (1)", "COMMIT",
+		"BEGIN", "INSERT INTO t VALUES (1)", "COMMIT",
+	}, srv.sentSQL())
+}
+
+func TestRunInTxAttemptsExhausted(t *testing.T) {
+	srv := conflictServer(t, 5)
+	defer srv.Close()
+	db := openTestDB(t, srv.URL)
+
+	runs := 0
+	err := RunInTx(context.Background(), db, &RunInTxOptions{MaxAttempts: 2, Backoff: time.Millisecond},
+		func(tx *sql.Tx) error {
+			runs++
+			return nil
+		})
+	var queryErr *QueryError
+	require.True(t, errors.As(err, &queryErr))
+	assert.Equal(t, 4001, queryErr.Code)
+	assert.Equal(t, 2, runs)
+}
+
+func TestRunInTxRollback(t *testing.T) {
+	srv := conflictServer(t, 0)
+	defer srv.Close()
+	db := openTestDB(t, srv.URL)
+
+	failed := errors.New("failed")
+	runs := 0
+	err := RunInTx(context.Background(), db, testRunInTxOptions, func(tx *sql.Tx) error {
+		runs++
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, []string{"BEGIN", "ROLLBACK"}, srv.sentSQL())
+
+	srv.queries = nil
+	assert.PanicsWithValue(t, "boom", func() {
+		_ = RunInTx(context.Background(), db, testRunInTxOptions, func(tx *sql.Tx) error {
+			panic("boom")
+		})
+	})
+	assert.Equal(t, []string{"BEGIN", "ROLLBACK"}, srv.sentSQL())
+}
+
+func TestIsRetryableTxnError(t *testing.T) {
+	assert.True(t, IsRetryableTxnError(pkgerrors.Wrap(&QueryError{Code: 4001}, "query error")))
+	assert.True(t, IsRetryableTxnError(pkgerrors.Wrap(&QueryError{Code: 2009}, "query error")))
+	assert.False(t, IsRetryableTxnError(pkgerrors.Wrap(&QueryError{Code: 1025}, "query error")))
+	assert.True(t, IsRetryableTxnError(APIError{StatusCode: 503}))
+	assert.True(t, IsRetryableTxnError(APIError{StatusCode: 400, RespBody: APIErrorResponseBody{Error: ProvisionWarehouseTimeout}}))
+	assert.False(t, IsRetryableTxnError(APIError{StatusCode: 401}))
+	assert.False(t, IsRetryableTxnError(context.Canceled))
+}
@@ -0,0 +1,238 @@
+package godatabend
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ContextKeyMultiStatement overrides Config.MultiStatement for the ExecContext and
+// QueryContext calls with the context, the value is a bool.
+const ContextKeyMultiStatement ContextKey = "MULTI-STATEMENT"
+
+// StatementError is the error of a statement of a multi-statement script, the
+// statements after it are not executed.
+type StatementError struct {
+	// Index is the index of the failed statement in the script, starting from 0.
+	Index int
+	SQL   string
+	Err   error
+}
+
+func (e *StatementError) Error() string {
+	return fmt.Sprintf("statement %d failed: %v", e.Index, e.Err)
+}
+
+func (e *StatementError) Unwrap() error {
+	return e.Err
+}
+
+// splitStatements splits the script into statements by the semicolons outside of the
+// quoted strings and identifiers, the comments and the $$ blocks. The statements are
+// trimmed, the empty ones and the ones of comments only are dropped.
+func splitStatements(script string) []string {
+	var (
+		statements []string
+		start      int
+		// hasCode is true if the current statement has anything but spaces and comments
+		hasCode bool
+	)
+	cut := func(end int) {
+		if hasCode {
+			statements = append(statements, strings.TrimSpace(script[start:end]))
+		}
+		start = end + 1
+		hasCode = false
+	}
+	for i := 0; i < len(script); i++ {
+		switch c := script[i]; {
+		case c == ';':
+			cut(i)
+		case c == '\'' || c == '"' || c == '`':
+			hasCode = true
+			i = skipQuoted(script, i, c)
+		case c == '-' && strings.HasPrefix(script[i:], "--"):
+			if end := strings.IndexByte(script[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(script)
+			}
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			if end := strings.Index(script[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(script)
+			}
+		case c == '$' && strings.HasPrefix(script[i:], "$$"):
+			hasCode = true
+			if end := strings.Index(script[i+2:], "$$"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(script)
+			}
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			hasCode = true
+		}
+	}
+	cut(len(script))
+	return statements
+}
+
+// skipQuoted returns the index of the closing quote of the string starting at i, the
+// quote is escaped by a backslash or by doubling it.
+func skipQuoted(script string, i int, quote byte) int {
+	for i++; i < len(script); i++ {
+		switch script[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(script) && script[i+1] == quote {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return len(script)
+}
+
+// multiStatement reports whether the query should be split into statements.
+func (dc *DatabendConn) multiStatement(ctx context.Context) bool {
+	if v, ok := ctx.Value(ContextKeyMultiStatement).(bool); ok {
+		return v
+	}
+	return dc.cfg != nil && dc.cfg.MultiStatement
+}
+
+// scriptStatements interpolates the arguments into the script and splits it, it returns
+// nil if the script has a single statement.
+func scriptStatements(script string, args []driver.Value) ([]string, error) {
+	q, err := buildQuery(script, args)
+	if err != nil {
+		return nil, err
+	}
+	statements := splitStatements(q)
+	if len(statements) < 2 {
+		return nil, nil
+	}
+	return statements, nil
+}
+
+// statementContext returns the context of the statement of a script, each statement is a
+// query of its own id. A query id given by the caller is suffixed by the statement number.
+func (dc *DatabendConn) statementContext(ctx context.Context, index int) context.Context {
+	queryID, ok := ctx.Value(ContextKeyQueryID).(string)
+	if !ok || isGeneratedQueryID(ctx) {
+		return withGeneratedQueryID(ctx, dc.rest.newQueryID())
+	}
+	return context.WithValue(ctx, ContextKeyQueryID, fmt.Sprintf("%s.%d", queryID, index+1))
+}
+
+// execScript executes the statements one by one in the session, and stops at the first
+// error. The result is the one of the last statement.
+func (dc *DatabendConn) execScript(ctx context.Context, statements []string) (driver.Result, error) {
+	var result driver.Result = emptyResult
+	for i, statement := range statements {
+		var err error
+		result, err = dc.exec(dc.statementContext(ctx, i), statement)
+		if err != nil {
+			return emptyResult, &StatementError{Index: i, SQL: statement, Err: err}
+		}
+	}
+	return result, nil
+}
+
+// queryScript starts the first statement, the following ones are started one by one by
+// NextResultSet, so each statement is only executed after the previous one is done.
+func (dc *DatabendConn) queryScript(ctx context.Context, statements []string) (driver.Rows, error) {
+	r := &scriptRows{dc: dc, ctx: ctx, statements: statements}
+	if err := r.start(0); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// scriptRows is the rows of a multi-statement script, every statement has a result set.
+type scriptRows struct {
+	dc         *DatabendConn
+	ctx        context.Context
+	statements []string
+	index      int
+	current    *nextRows
+}
+
+func (r *scriptRows) start(index int) error {
+	rows, err := r.dc.query(r.dc.statementContext(r.ctx, index), r.statements[index])
+	if err != nil {
+		return &StatementError{Index: index, SQL: r.statements[index], Err: err}
+	}
+	r.index = index
+	r.current = rows.(*nextRows)
+	return nil
+}
+
+func (r *scriptRows) Columns() []string {
+	return r.current.Columns()
+}
+
+// Close closes the result set of the current statement, the rest statements are not
+// executed.
+func (r *scriptRows) Close() error {
+	return r.current.Close()
+}
+
+func (r *scriptRows) Next(dest []driver.Value) error {
+	return r.current.Next(dest)
+}
+
+// HasNextResultSet implements driver.RowsNextResultSet.
+func (r *scriptRows) HasNextResultSet() bool {
+	return r.index+1 < len(r.statements)
+}
+
+// NextResultSet implements driver.RowsNextResultSet, it closes the result set of the
+// current statement and executes the next one.
+func (r *scriptRows) NextResultSet() error {
+	if !r.HasNextResultSet() {
+		return io.EOF
+	}
+	if err := r.current.Close(); err != nil {
+		return err
+	}
+	return r.start(r.index + 1)
+}
+
+func (r *scriptRows) ColumnTypeScanType(index int) reflect.Type {
+	return r.current.ColumnTypeScanType(index)
+}
+
+func (r *scriptRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.current.ColumnTypeDatabaseTypeName(index)
+}
+
+func (r *scriptRows) ColumnTypeNullable(index int) (bool, bool) {
+	return r.current.ColumnTypeNullable(index)
+}
+
+// QueryID, NodeID, Stats and Elapsed implement QueryInfo of the current statement.
+func (r *scriptRows) QueryID() string {
+	return r.current.QueryID()
+}
+
+func (r *scriptRows) NodeID() string {
+	return r.current.NodeID()
+}
+
+func (r *scriptRows) Stats() *QueryStats {
+	return r.current.Stats()
+}
+
+func (r *scriptRows) Elapsed() time.Duration {
+	return r.current.Elapsed()
+}
+
+var _ driver.RowsNextResultSet = (*scriptRows)(nil)
@@ -0,0 +1,119 @@
+package godatabend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		script string
+		expect []string
+	}{
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{" ;; SELECT 1 ;\n", []string{"SELECT 1"}},
+		{`SELECT 'a;b', "c;d", ` + "`e;f`" + `; SELECT 'it''s;', 'x\';y'`,
+			[]string{`SELECT 'a;b', "c;d", ` + "`e;f`", `SELECT 'it''s;', 'x\';y'`}},
+		{"-- header; comment\nSELECT 1; /* a; b */ SELECT 2; -- trailing; comment",
+			[]string{"-- header; comment\nSELECT 1", "/* a; b */ SELECT 2"}},
+		{"CREATE FUNCTION f() RETURNS INT LANGUAGE python HANDLER = 'f' AS $$\ndef f(): return 1; # one\n$$; SELECT f()",
+			[]string{"CREATE FUNCTION f() RETURNS INT LANGUAGE python HANDLER = 'f' AS $$\ndef f(): return 1; # one\n$$", "SELECT f()"}},
+		{"-- only a comment;", nil},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expect, splitStatements(test.script), test.script)
+	}
+}
+
+func TestExecScript(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		if strings.Contains(req.SQL, "missing") {
+			return `{"id":"q1","state":"Failed","error":{"code":1025,"message":"Unknown table missing"}}`
+		}
+		return `{"id":"q1","state":"Succeeded"}`
+	}
+	db := openTestDB(t, srv.URL)
+	ctx := context.WithValue(context.Background(), ContextKeyMultiStatement, true)
+
+	_, err := db.ExecContext(ctx, "CREATE TABLE t (a INT); INSERT INTO t VALUES (?); -- done", 1)
+	require.NoError(t, err)
+	require.Len(t, srv.queries, 2)
+	assert.Equal(t, "CREATE TABLE t (a INT)", srv.queries[0].SQL)
+	assert.Equal(t, "INSERT INTO t VALUES (1)", srv.queries[1].SQL)
+
+	srv.queries = nil
+	_, err = db.ExecContext(ctx, "INSERT INTO t VALUES (2); INSERT INTO missing VALUES (3); INSERT INTO t VALUES (4)")
+	var stmtErr *StatementError
+	require.True(t, errors.As(err, &stmtErr))
+	assert.Equal(t, 1, stmtErr.Index)
+	assert.Equal(t, "INSERT INTO missing VALUES (3)", stmtErr.SQL)
+	assert.ErrorContains(t, err, "Unknown table missing")
+	assert.Len(t, srv.queries, 2)
+
+	// the script is sent as it is without the option
+	srv.queries = nil
+	_, err = db.Exec("INSERT INTO t VALUES (5); INSERT INTO t VALUES (6)")
+	require.NoError(t, err)
+	assert.Len(t, srv.queries, 1)
+}
+
+func TestStatementContext(t *testing.T) {
+	dc := newTestConn(t, "localhost:8000")
+
+	// the ids generated for the statements are checked like the other generated ones
+	ctx := dc.statementContext(context.Background(), 0)
+	assert.True(t, isGeneratedQueryID(ctx))
+	first := ctx.Value(ContextKeyQueryID).(string)
+	ctx = dc.statementContext(dc.rest.checkQueryID(context.Background()), 1)
+	assert.True(t, isGeneratedQueryID(ctx))
+	assert.NotEqual(t, first, ctx.Value(ContextKeyQueryID))
+
+	ctx = dc.statementContext(context.WithValue(context.Background(), ContextKeyQueryID, "my-id"), 1)
+	assert.False(t, isGeneratedQueryID(ctx))
+	assert.Equal(t, "my-id.2", ctx.Value(ContextKeyQueryID))
+}
+
+func TestQueryScriptResultSets(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		var n int
+		if _, err := fmt.Sscanf(req.SQL, "SELECT %d", &n); err != nil {
+			return `{"id":"q1","state":"Failed","error":{"code":1005,"message":"syntax error"}}`
+		}
+		return fmt.Sprintf(`{"id":"q%d","state":"Succeeded","schema":[{"name":"n","type":"Int64"}],"data":[["%d"]]}`, n, n)
+	}
+	db := openTestDB(t, srv.URL)
+	ctx := context.WithValue(context.Background(), ContextKeyMultiStatement, true)
+
+	rows, err := db.QueryContext(ctx, "SELECT 1; SELECT 2; SELEC 3")
+	require.NoError(t, err)
+	defer rows.Close()
+	var got []int
+	for {
+		for rows.Next() {
+			var n int
+			require.NoError(t, rows.Scan(&n))
+			got = append(got, n)
+		}
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	assert.Equal(t, []int{1, 2}, got)
+	var stmtErr *StatementError
+	require.True(t, errors.As(rows.Err(), &stmtErr))
+	assert.Equal(t, 2, stmtErr.Index)
+
+	// every statement is a query of its own
+	require.Len(t, srv.queries, 3)
+}
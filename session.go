@@ -0,0 +1,249 @@
+package godatabend
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Setting is a setting of the session listed in system.settings.
+type Setting struct {
+	Name        string
+	Value       string
+	Default     string
+	Level       string
+	Description string
+	// Type is the type of the value, such as UInt64 or String.
+	Type string
+}
+
+var settingColumns = []string{"name", "value", "default", "level", "description", "type"}
+
+// Session returns a copy of the session state sent with the next query of the connection.
+func (dc *DatabendConn) Session() SessionState {
+	if dc.rest == nil || dc.rest.sessionState == nil {
+		return SessionState{}
+	}
+	state := *dc.rest.sessionState
+	if state.Settings != nil {
+		state.Settings = make(map[string]string, len(dc.rest.sessionState.Settings))
+		for k, v := range dc.rest.sessionState.Settings {
+			state.Settings[k] = v
+		}
+	}
+	if state.SecondaryRoles != nil {
+		roles := append([]string{}, *state.SecondaryRoles...)
+		state.SecondaryRoles = &roles
+	}
+	return state
+}
+
+// Settings returns all the settings with their values in the session of the connection.
+func (dc *DatabendConn) Settings(ctx context.Context) ([]Setting, error) {
+	if dc.rest == nil {
+		return nil, driver.ErrBadConn
+	}
+	query := fmt.Sprintf("SELECT %s FROM system.settings ORDER BY name", strings.Join(settingColumns, ", "))
+	resp, err := dc.rest.QuerySync(ctx, query, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "list settings failed")
+	}
+	rows := newResultRows(resp, settingColumns)
+	settings := make([]Setting, 0, rows.len())
+	types := make(map[string]string, rows.len())
+	for i := 0; i < rows.len(); i++ {
+		setting := Setting{
+			Name:        rows.value(i, "name"),
+			Value:       rows.value(i, "value"),
+			Default:     rows.value(i, "default"),
+			Level:       rows.value(i, "level"),
+			Description: rows.value(i, "description"),
+			Type:        rows.value(i, "type"),
+		}
+		settings = append(settings, setting)
+		types[setting.Name] = setting.Type
+	}
+	dc.settingTypes = types
+	return settings, nil
+}
+
+// Setting returns the value of the setting in the session of the connection.
+func (dc *DatabendConn) Setting(ctx context.Context, name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if _, err := dc.settingType(ctx, name); err != nil {
+		return "", err
+	}
+	if v, ok := dc.Session().Settings[name]; ok {
+		return v, nil
+	}
+	settings, err := dc.Settings(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, setting := range settings {
+		if setting.Name == name {
+			return setting.Value, nil
+		}
+	}
+	return "", errors.Errorf("unknown setting %q", name)
+}
+
+// SetSetting sets the setting in the session of the connection, it's sent with the next
+// query. The name and the type of the value are checked against system.settings.
+func (dc *DatabendConn) SetSetting(ctx context.Context, name, value string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	typ, err := dc.settingType(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := validateSettingValue(typ, value); err != nil {
+		return errors.Wrapf(err, "invalid value of setting %s", name)
+	}
+	return dc.rest.updateSessionSettings(func(settings map[string]string) {
+		settings[name] = value
+	})
+}
+
+// UnsetSetting removes the setting from the session of the connection, so the next query
+// runs with the value of the user, the tenant or the default one.
+func (dc *DatabendConn) UnsetSetting(ctx context.Context, name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if _, err := dc.settingType(ctx, name); err != nil {
+		return err
+	}
+	return dc.rest.updateSessionSettings(func(settings map[string]string) {
+		delete(settings, name)
+	})
+}
+
+// UseRole switches the current role of the session, the role must be granted to the user.
+func (dc *DatabendConn) UseRole(ctx context.Context, role string) error {
+	if dc.rest == nil {
+		return driver.ErrBadConn
+	}
+	if role == "" {
+		return errors.New("role is empty")
+	}
+	if _, err := dc.rest.QuerySync(ctx, fmt.Sprintf("SET ROLE %s", quoteString(role)), nil); err != nil {
+		return errors.Wrapf(err, "set role %s failed", role)
+	}
+	return dc.rest.updateSessionField("role", role)
+}
+
+// SetSecondaryRoles sets the secondary roles of the session, nil enables all the roles
+// granted to the user and an empty slice enables none of them. The roles are checked by
+// the server with the next query.
+func (dc *DatabendConn) SetSecondaryRoles(ctx context.Context, roles []string) error {
+	if dc.rest == nil {
+		return driver.ErrBadConn
+	}
+	if roles == nil {
+		return dc.rest.updateSessionField("secondary_roles", nil)
+	}
+	return dc.rest.updateSessionField("secondary_roles", roles)
+}
+
+// UseDatabase changes the current database of the session, the database must exist.
+func (dc *DatabendConn) UseDatabase(ctx context.Context, database string) error {
+	if dc.rest == nil {
+		return driver.ErrBadConn
+	}
+	if database == "" {
+		return errors.New("database is empty")
+	}
+	if _, err := dc.rest.QuerySync(ctx, fmt.Sprintf("USE %s", quoteIdentifier(database)), nil); err != nil {
+		return errors.Wrapf(err, "use database %s failed", database)
+	}
+	return dc.rest.updateSessionField("database", database)
+}
+
+// settingType returns the type of the setting, the settings of the server are loaded on
+// the first call of the connection.
+func (dc *DatabendConn) settingType(ctx context.Context, name string) (string, error) {
+	if dc.rest == nil {
+		return "", driver.ErrBadConn
+	}
+	if dc.settingTypes == nil {
+		if _, err := dc.Settings(ctx); err != nil {
+			return "", err
+		}
+	}
+	typ, ok := dc.settingTypes[name]
+	if !ok {
+		return "", errors.Errorf("unknown setting %q", name)
+	}
+	return typ, nil
+}
+
+func validateSettingValue(typ, value string) error {
+	var err error
+	switch strings.ToLower(typ) {
+	case "uint64":
+		_, err = strconv.ParseUint(value, 10, 64)
+	case "int64":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "float64":
+		_, err = strconv.ParseFloat(value, 64)
+	}
+	if err != nil {
+		return errors.Errorf("%q is not a valid %s", value, typ)
+	}
+	return nil
+}
+
+func quoteIdentifier(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "``") + "`"
+}
+
+// updateSessionSettings changes the settings of the session sent with the next query.
+func (c *APIClient) updateSessionSettings(fn func(settings map[string]string)) error {
+	raw, err := rewriteSessionSettings(c.sessionStateRaw, fn)
+	if err != nil {
+		return err
+	}
+	c.setSessionStateRaw(raw)
+	return nil
+}
+
+// updateSessionField sets the field of the session sent with the next query, a nil value
+// removes it. The fields unknown to SessionState are kept.
+func (c *APIClient) updateSessionField(name string, value interface{}) error {
+	fields := map[string]json.RawMessage{}
+	if c.sessionStateRaw != nil {
+		if err := json.Unmarshal(*c.sessionStateRaw, &fields); err != nil {
+			return errors.Wrap(err, "failed to unmarshal session state")
+		}
+	}
+	if value == nil {
+		delete(fields, name)
+	} else {
+		buf, err := json.Marshal(value)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal session %s", name)
+		}
+		fields[name] = buf
+	}
+	buf, err := json.Marshal(fields)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal session state")
+	}
+	raw := json.RawMessage(buf)
+	c.setSessionStateRaw(&raw)
+	return nil
+}
+
+// setSessionStateRaw replaces the session, the state is decoded from the raw json again so
+// no field of the previous one is left.
+func (c *APIClient) setSessionStateRaw(raw *json.RawMessage) {
+	state := SessionState{}
+	if raw != nil {
+		_ = json.Unmarshal(*raw, &state)
+	}
+	c.sessionStateRaw = raw
+	c.sessionState = &state
+}
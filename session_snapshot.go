@@ -0,0 +1,112 @@
+package godatabend
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sessionSnapshotVersion is the version of the format of SessionSnapshot, it's increased
+// whenever a snapshot could not be imported by the drivers of the older versions.
+const sessionSnapshotVersion = 1
+
+// SessionSnapshot is the portable state of a session exported by ExportSession, so a
+// process could continue the session, including an active transaction, started by another
+// one connected to the same server as the same user.
+type SessionSnapshot struct {
+	Version int `json:"version"`
+	// DriverVersion is the version of the driver which exported the snapshot.
+	DriverVersion string `json:"driver_version"`
+
+	Host      string `json:"host"`
+	Tenant    string `json:"tenant,omitempty"`
+	Warehouse string `json:"warehouse,omitempty"`
+	User      string `json:"user,omitempty"`
+
+	// Session is the session json echoed by the server, with the fields unknown to
+	// SessionState kept.
+	Session json.RawMessage `json:"session"`
+	// RouteHint routes the queries to the node of the session, the one holding the
+	// active transaction.
+	RouteHint string   `json:"route_hint,omitempty"`
+	TxnState  TxnState `json:"txn_state,omitempty"`
+}
+
+// ExportSession serializes the session of the connection as a SessionSnapshot. It must not
+// be called while a query of the connection is running. The session of an active
+// transaction should only be imported once, and not used by this connection afterwards.
+func (dc *DatabendConn) ExportSession() ([]byte, error) {
+	if dc.rest == nil {
+		return nil, driver.ErrBadConn
+	}
+	c := dc.rest
+	snapshot := SessionSnapshot{
+		Version:       sessionSnapshotVersion,
+		DriverVersion: strings.TrimSpace(version),
+		Host:          c.host,
+		Tenant:        c.tenant,
+		Warehouse:     c.warehouse,
+		User:          c.user,
+		RouteHint:     c.routeHint,
+	}
+	if c.sessionStateRaw != nil {
+		snapshot.Session = append(json.RawMessage(nil), *c.sessionStateRaw...)
+	}
+	if c.sessionState != nil {
+		snapshot.TxnState = c.sessionState.TxnState
+	}
+	buf, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal session snapshot")
+	}
+	return buf, nil
+}
+
+// ImportSession replaces the session of the connection by the snapshot exported by
+// ExportSession. The snapshot is refused if its format is unknown, if it's of another
+// server or user, or if the connection is in an active transaction.
+func (dc *DatabendConn) ImportSession(data []byte) error {
+	if dc.rest == nil {
+		return driver.ErrBadConn
+	}
+	c := dc.rest
+	var snapshot SessionSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return errors.Wrap(err, "failed to unmarshal session snapshot")
+	}
+	if snapshot.Version != sessionSnapshotVersion {
+		return errors.Errorf("unsupported session snapshot version %d of driver %s, expect version %d",
+			snapshot.Version, snapshot.DriverVersion, sessionSnapshotVersion)
+	}
+	if snapshot.Host != c.host || snapshot.Tenant != c.tenant || snapshot.Warehouse != c.warehouse || snapshot.User != c.user {
+		return errors.Errorf("session snapshot of %s@%s is not of the connection %s@%s",
+			snapshot.User, snapshot.Host, c.user, c.host)
+	}
+	if len(snapshot.Session) == 0 {
+		return errors.New("session snapshot has no session")
+	}
+	state := SessionState{}
+	if err := json.Unmarshal(snapshot.Session, &state); err != nil {
+		return errors.Wrap(err, "invalid session of the snapshot")
+	}
+	if state.TxnState != snapshot.TxnState {
+		return errors.Errorf("session snapshot txn state %q does not match the session %q", snapshot.TxnState, state.TxnState)
+	}
+	if strings.EqualFold(string(state.TxnState), string(TxnStateActive)) && snapshot.RouteHint == "" {
+		return errors.New("session snapshot in an active transaction has no route hint")
+	}
+	if c.inActiveTransaction() {
+		return errors.New("can not import a session into the connection in an active transaction")
+	}
+
+	raw := append(json.RawMessage(nil), snapshot.Session...)
+	c.setSessionStateRaw(&raw)
+	c.settingsOverride = nil
+	c.settingsOriginal = nil
+	if snapshot.RouteHint != "" {
+		c.routeHint = snapshot.RouteHint
+	}
+	return nil
+}
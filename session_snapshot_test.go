@@ -0,0 +1,71 @@
+package godatabend
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportSession(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = echoSession
+	ctx := context.Background()
+
+	dc1 := newTestConn(t, srv.URL)
+	for _, query := range []string{"SET max_threads = 1", "BEGIN"} {
+		_, err := dc1.exec(ctx, query)
+		require.NoError(t, err)
+	}
+	data, err := dc1.ExportSession()
+	require.NoError(t, err)
+
+	dc2 := newTestConn(t, srv.URL)
+	require.NoError(t, dc2.ImportSession(data))
+	assert.True(t, dc2.rest.inActiveTransaction())
+	assert.Equal(t, dc1.rest.routeHint, dc2.rest.routeHint)
+
+	// the transaction goes on by the second connection on the same node
+	srv.queries = nil
+	_, err = dc2.exec(ctx, "INSERT INTO t VALUES (1)")
+	require.NoError(t, err)
+	assert.Equal(t, dc1.rest.routeHint, dc2.rest.routeHint)
+	assert.JSONEq(t, `{"settings":{"max_threads":"1"},"txn_state":"Active"}`, string(*srv.queries[0].Session))
+
+	// no session is imported into an active transaction
+	assert.ErrorContains(t, dc2.ImportSession(data), "active transaction")
+}
+
+func TestImportSessionChecks(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	dc := newTestConn(t, srv.URL)
+	data, err := dc.ExportSession()
+	require.NoError(t, err)
+
+	change := func(fn func(s *SessionSnapshot)) []byte {
+		var snapshot SessionSnapshot
+		require.NoError(t, json.Unmarshal(data, &snapshot))
+		fn(&snapshot)
+		buf, err := json.Marshal(snapshot)
+		require.NoError(t, err)
+		return buf
+	}
+
+	require.NoError(t, dc.ImportSession(data))
+	assert.ErrorContains(t, dc.ImportSession([]byte("{")), "unmarshal")
+	assert.ErrorContains(t, dc.ImportSession(change(func(s *SessionSnapshot) { s.Version = 2 })),
+		"unsupported session snapshot version 2")
+	assert.ErrorContains(t, dc.ImportSession(change(func(s *SessionSnapshot) { s.User = "other" })),
+		"is not of the connection")
+	assert.ErrorContains(t, dc.ImportSession(change(func(s *SessionSnapshot) { s.TxnState = TxnStateActive })),
+		"does not match")
+	assert.ErrorContains(t, dc.ImportSession(change(func(s *SessionSnapshot) {
+		s.Session = json.RawMessage(`{"txn_state":"Active"}`)
+		s.TxnState = TxnStateActive
+		s.RouteHint = ""
+	})), "no route hint")
+}
@@ -0,0 +1,97 @@
+package godatabend
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const settingsResponse = `{"id":"q1","state":"Succeeded",
+"schema":[{"name":"name","type":"String"},{"name":"value","type":"String"},{"name":"default","type":"String"},
+{"name":"level","type":"String"},{"name":"description","type":"String"},{"name":"type","type":"String"}],
+"data":[["max_threads","8","8","DEFAULT","The maximum number of threads.","UInt64"],
+["timezone","UTC","UTC","DEFAULT","The timezone.","String"]]}`
+
+func sessionServer(t *testing.T) *testServer {
+	srv := newTestServer(t)
+	srv.onQuery = func(req QueryRequest) string {
+		switch {
+		case strings.Contains(req.SQL, "system.settings"):
+			return settingsResponse
+		case strings.Contains(req.SQL, "missing"):
+			return `{"id":"q1","state":"Failed","error":{"code":1003,"message":"Unknown database missing"}}`
+		}
+		return echoSession(req)
+	}
+	return srv
+}
+
+func TestSessionSettings(t *testing.T) {
+	srv := sessionServer(t)
+	defer srv.Close()
+	dc := newTestConn(t, srv.URL)
+	ctx := context.Background()
+
+	settings, err := dc.Settings(ctx)
+	require.NoError(t, err)
+	require.Len(t, settings, 2)
+	assert.Equal(t, Setting{Name: "max_threads", Value: "8", Default: "8", Level: "DEFAULT",
+		Description: "The maximum number of threads.", Type: "UInt64"}, settings[0])
+
+	require.NoError(t, dc.SetSetting(ctx, "MAX_THREADS", "4"))
+	require.NoError(t, dc.SetSetting(ctx, "timezone", "Asia/Shanghai"))
+	assert.ErrorContains(t, dc.SetSetting(ctx, "max_threads", "four"), "not a valid UInt64")
+	assert.ErrorContains(t, dc.SetSetting(ctx, "no_such_setting", "1"), "unknown setting")
+	assert.Equal(t, map[string]string{"max_threads": "4", "timezone": "Asia/Shanghai"}, dc.Session().Settings)
+
+	v, err := dc.Setting(ctx, "max_threads")
+	require.NoError(t, err)
+	assert.Equal(t, "4", v)
+
+	require.NoError(t, dc.UnsetSetting(ctx, "timezone"))
+	v, err = dc.Setting(ctx, "timezone")
+	require.NoError(t, err)
+	assert.Equal(t, "UTC", v)
+
+	// the change is sent with the next query
+	srv.queries = nil
+	_, err = dc.exec(ctx, "SELECT 1")
+	require.NoError(t, err)
+	require.Len(t, srv.queries, 1)
+	assert.Equal(t, `{"settings":{"max_threads":"4"}}`, string(*srv.queries[0].Session))
+}
+
+func TestSessionRoleAndDatabase(t *testing.T) {
+	srv := sessionServer(t)
+	defer srv.Close()
+	dc := newTestConn(t, srv.URL)
+	ctx := context.Background()
+
+	require.NoError(t, dc.UseRole(ctx, "r2"))
+	require.NoError(t, dc.SetSecondaryRoles(ctx, []string{}))
+	require.NoError(t, dc.UseDatabase(ctx, "db2"))
+	assert.ErrorContains(t, dc.UseDatabase(ctx, "missing"), "Unknown database missing")
+	assert.Equal(t, "SET ROLE 'r2'", srv.queries[0].SQL)
+	assert.Equal(t, "USE `db2`", srv.queries[1].SQL)
+
+	session := dc.Session()
+	assert.Equal(t, "r2", session.Role)
+	assert.Equal(t, "db2", session.Database)
+	require.NotNil(t, session.SecondaryRoles)
+	assert.Empty(t, *session.SecondaryRoles)
+
+	srv.queries = nil
+	_, err := dc.exec(ctx, "SELECT 1")
+	require.NoError(t, err)
+	sent := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(*srv.queries[0].Session, &sent))
+	assert.Equal(t, map[string]interface{}{"role": "r2", "database": "db2", "secondary_roles": []interface{}{}}, sent)
+
+	// nil enables all the granted roles
+	require.NoError(t, dc.SetSecondaryRoles(ctx, nil))
+	assert.Nil(t, dc.Session().SecondaryRoles)
+}
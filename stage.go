@@ -0,0 +1,173 @@
+package godatabend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StageFile is a file listed in a stage.
+type StageFile struct {
+	// Name is the path of the file relative to the stage.
+	Name         string
+	Size         int64
+	MD5          string
+	LastModified time.Time
+}
+
+var stageTimeLayouts = []string{
+	"2006-01-02 15:04:05.000 -0700",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05.999999 -0700",
+	time.RFC3339Nano,
+	time.RFC1123,
+}
+
+func parseStageTime(v string) (time.Time, error) {
+	for _, layout := range stageTimeLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid last_modified %q", v)
+}
+
+// ListStage lists the files under the path of the stage, such as the user stage `~` or
+// a named stage. The pattern is an optional regular expression the file names must match.
+func (c *APIClient) ListStage(ctx context.Context, stage *StageLocation, pattern string) ([]StageFile, error) {
+	query := fmt.Sprintf("LIST %s", stage)
+	if pattern != "" {
+		query += fmt.Sprintf(" PATTERN = %s", quoteString(pattern))
+	}
+	resp, err := c.QuerySync(ctx, query, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "list stage failed")
+	}
+
+	rows := newResultRows(resp, []string{"name", "size", "md5", "last_modified"})
+	files := make([]StageFile, 0, rows.len())
+	for i := 0; i < rows.len(); i++ {
+		file := StageFile{Name: rows.value(i, "name"), MD5: strings.Trim(rows.value(i, "md5"), `"`)}
+		if file.Size, err = rows.int64Value(i, "size"); err != nil {
+			return nil, err
+		}
+		if v := rows.value(i, "last_modified"); v != "" {
+			if file.LastModified, err = parseStageTime(v); err != nil {
+				return nil, err
+			}
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// OpenStageFile opens the file of the stage by its presigned download url. The reading
+// starts from the offset, and stops after length bytes if the length is positive, so a
+// part of a large file could be fetched by a range request. The caller must close it.
+func (c *APIClient) OpenStageFile(ctx context.Context, stage *StageLocation, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.Errorf("invalid offset %d", offset)
+	}
+	presigned, err := c.GetPresignedDownloadURL(ctx, stage)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get presigned url")
+	}
+	method := presigned.Method
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, presigned.URL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create http request")
+	}
+	req = req.WithContext(ctx)
+	for k, v := range presigned.Headers {
+		req.Header.Set(k, v)
+	}
+	if length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := c.downloadHTTPClient().Do(req)
+	if err != nil {
+		return nil, errors.Wrap(ErrDoRequest, "failed to download from stage by presigned url: "+err.Error())
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		// the range is not supported by the storage, the whole file is responded
+		if offset > 0 {
+			if _, err = io.CopyN(io.Discard, resp.Body, offset); err != nil {
+				_ = resp.Body.Close()
+				return nil, errors.Wrap(err, "failed to skip to the offset")
+			}
+		}
+		if length > 0 {
+			return &limitedReadCloser{Reader: io.LimitReader(resp.Body, length), Closer: resp.Body}, nil
+		}
+		return resp.Body, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the offset is at the end of the file
+		_ = resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	default:
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, errors.Errorf("failed to download from stage by presigned url, status code: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+}
+
+// downloadHTTPClient returns the client of the stage downloads, which are only bounded by
+// the context, not the timeout of the queries, as a large file could take long to read.
+func (c *APIClient) downloadHTTPClient() *http.Client {
+	cli := &http.Client{}
+	if c.cli != nil {
+		cli.Transport = c.cli.Transport
+	}
+	return cli
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// DownloadStageFile writes the whole file of the stage into the writer, and returns the
+// number of bytes written.
+func (c *APIClient) DownloadStageFile(ctx context.Context, stage *StageLocation, w io.Writer) (int64, error) {
+	r, err := c.OpenStageFile(ctx, stage, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return n, errors.Wrap(err, "failed to download from stage")
+	}
+	return n, nil
+}
+
+// RemoveStageFiles removes the files under the path of the stage, the pattern is an
+// optional regular expression the removed file names must match.
+func (c *APIClient) RemoveStageFiles(ctx context.Context, stage *StageLocation, pattern string) error {
+	query := fmt.Sprintf("REMOVE %s", stage)
+	if pattern != "" {
+		query += fmt.Sprintf(" PATTERN = %s", quoteString(pattern))
+	}
+	if _, err := c.QuerySync(ctx, query, nil); err != nil {
+		return errors.Wrap(err, "remove stage files failed")
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package godatabend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListStage(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = func(req QueryRequest) string {
+		return `{"id":"q1","state":"Succeeded",
+"schema":[{"name":"name","type":"String"},{"name":"size","type":"UInt64"},{"name":"md5","type":"Nullable(String)"},{"name":"last_modified","type":"String"},{"name":"creator","type":"Nullable(String)"}],
+"data":[["a/1.csv","12","\"0cc175b9c0f1b6a831c399e269772661\"","2024-01-02 03:04:05.000 +0000",null],["a/2.csv","0",null,"2024-01-02 03:04:06.000 +0000",null]]}`
+	}
+
+	dc := newTestConn(t, srv.URL)
+	files, err := dc.rest.ListStage(context.Background(), &StageLocation{Name: "~", Path: "a/"}, `.*\.csv`)
+	require.NoError(t, err)
+	assert.Equal(t, `LIST @~/a/ PATTERN = '.*\\.csv'`, srv.queries[0].SQL)
+	assert.Equal(t, []StageFile{
+		{Name: "a/1.csv", Size: 12, MD5: "0cc175b9c0f1b6a831c399e269772661", LastModified: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{Name: "a/2.csv", LastModified: time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC)},
+	}, normalizeStageFiles(files))
+
+	require.NoError(t, dc.rest.RemoveStageFiles(context.Background(), &StageLocation{Name: "s1", Path: "a/"}, ""))
+	assert.Equal(t, "REMOVE @s1/a/", srv.queries[1].SQL)
+}
+
+func normalizeStageFiles(files []StageFile) []StageFile {
+	for i := range files {
+		files[i].LastModified = files[i].LastModified.UTC()
+	}
+	return files
+}
+
+func TestOpenStageFile(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	srv := newTestServer(t)
+	defer srv.Close()
+	var rangeSupported = true
+	var slow bool
+	srv.Config.Handler = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/download" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.Header.Get("X-Test") != "1" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if slow {
+				_, _ = w.Write([]byte(content[:10]))
+				w.(http.Flusher).Flush()
+				time.Sleep(200 * time.Millisecond)
+				_, _ = w.Write([]byte(content[10:]))
+				return
+			}
+			if !rangeSupported {
+				_, _ = w.Write([]byte(content))
+				return
+			}
+			http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+		})
+	}(srv.Config.Handler)
+	srv.onQuery = func(req QueryRequest) string {
+		return fmt.Sprintf(`{"id":"q1","state":"Succeeded","data":[["GET","{\"X-Test\":\"1\"}","%s/download"]]}`, srv.URL)
+	}
+
+	dc := newTestConn(t, srv.URL)
+	stage := &StageLocation{Name: "~", Path: "a/1.csv"}
+	read := func(offset, length int64) string {
+		r, err := dc.rest.OpenStageFile(context.Background(), stage, offset, length)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return string(data)
+	}
+	assert.Equal(t, content, read(0, 0))
+	assert.Equal(t, "abcdefghij", read(10, 0))
+	assert.Equal(t, "345", read(3, 3))
+	assert.Equal(t, "PRESIGN DOWNLOAD @~/a/1.csv", srv.queries[0].SQL)
+
+	rangeSupported = false
+	assert.Equal(t, "345", read(3, 3))
+	assert.Equal(t, "abcdefghij", read(10, 0))
+
+	// the download is not limited by the timeout of the queries
+	slow = true
+	dc.rest.cli.Timeout = 100 * time.Millisecond
+	var buf bytes.Buffer
+	n, err := dc.rest.DownloadStageFile(context.Background(), stage, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.Equal(t, content, buf.String())
+
+	srv.onQuery = func(req QueryRequest) string {
+		return `{"id":"q1","state":"Succeeded","data":[["GET","{}","http://127.0.0.1:1/download"]]}`
+	}
+	_, err = dc.rest.OpenStageFile(context.Background(), stage, 0, 0)
+	assert.True(t, errors.Is(err, ErrDoRequest), err)
+}
@@ -0,0 +1,200 @@
+package godatabend
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// StreamingLoadLocation is the placeholder stage of the streaming load data in the sql.
+const StreamingLoadLocation = "@_databend_load"
+
+// LoadResponse is the result of a streaming load.
+type LoadResponse struct {
+	ID    string        `json:"id"`
+	Stats QueryProgress `json:"stats"`
+	Error *QueryError   `json:"error"`
+}
+
+// StreamingLoad streams the data of the reader into the server by the streaming load
+// API in a single request, without going through a stage. The sql is an insert or
+// replace statement reading from @_databend_load, for example
+// `INSERT INTO t FROM @_databend_load`, the file format clause built from the
+// formatOptions is appended to it, the CSV format options by default. The sql is sent
+// in a header, so it's put on a single line, and a line break in a quoted string must
+// be escaped.
+func (c *APIClient) StreamingLoad(ctx context.Context, sql string, input io.Reader, formatOptions map[string]string) (*LoadResponse, error) {
+	if formatOptions == nil {
+		formatOptions = c.NewDefaultCSVFormatOptions()
+	}
+	sql, err := singleLineSQL(sql)
+	if err != nil {
+		return nil, err
+	}
+	sql = fmt.Sprintf("%s FILE_FORMAT = (%s)", sql, formatFileFormatOptions(formatOptions))
+
+	session, err := c.makeSessionStateRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, formContentType := newMultipartBody("upload", "data", input, "")
+	defer func() {
+		_ = body.Close()
+	}()
+
+	req, err := http.NewRequest("PUT", c.makeURL("/v1/streaming_load"), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create http request")
+	}
+	req = req.WithContext(ctx)
+	req.Header, err = c.makeHeaders(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to make headers")
+	}
+	if len(c.host) > 0 {
+		req.Host = c.host
+	}
+	req.Header.Set(DatabendSQLHeader, sql)
+	if session != nil {
+		req.Header.Set(DatabendQueryContext, string(*session))
+	}
+	req.Header.Set(contentType, formContentType)
+	req.Header.Set(accept, jsonContentType)
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(ErrDoRequest, err.Error())
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(ErrReadResponse, err.Error())
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, NewAPIError("please check your user/password.", resp.StatusCode, respBody)
+	} else if resp.StatusCode >= 500 {
+		return nil, NewAPIError("please retry again later.", resp.StatusCode, respBody)
+	} else if resp.StatusCode >= 400 {
+		return nil, NewAPIError("please check your arguments.", resp.StatusCode, respBody)
+	}
+
+	result := &LoadResponse{}
+	if err := json.Unmarshal(respBody, result); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal response body")
+	}
+	if result.Error != nil {
+		return result, errors.Wrap(result.Error, "streaming load error")
+	}
+	return result, nil
+}
+
+// singleLineSQL puts the sql on a single line, so it can be sent in the header. The line
+// breaks outside of the quoted strings are spaces to SQL, and the line comments are
+// dropped, but a control character in a quoted string or a $$ block can't be replaced
+// without changing the sql, so it's rejected.
+func singleLineSQL(sql string) (string, error) {
+	var b strings.Builder
+	quoted := func(start, end int) error {
+		if end >= len(sql) {
+			end = len(sql) - 1
+		}
+		s := sql[start : end+1]
+		if strings.IndexFunc(s, isControl) >= 0 {
+			return errors.Errorf("the streaming load sql is sent in the %s header, the line breaks and control characters in the quoted strings must be escaped: %q", DatabendSQLHeader, s)
+		}
+		b.WriteString(s)
+		return nil
+	}
+	for i := 0; i < len(sql); i++ {
+		switch c := sql[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			end := skipQuoted(sql, i, c)
+			if err := quoted(i, end); err != nil {
+				return "", err
+			}
+			i = end
+		case c == '$' && strings.HasPrefix(sql[i:], "$$"):
+			end := len(sql)
+			if n := strings.Index(sql[i+2:], "$$"); n >= 0 {
+				end = i + n + 3
+			}
+			if err := quoted(i, end); err != nil {
+				return "", err
+			}
+			i = end
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			// the line break ending the comment is kept as a space
+			if end := strings.IndexByte(sql[i:], '\n'); end >= 0 {
+				i += end - 1
+			} else {
+				i = len(sql)
+			}
+		case c == '\n' || c == '\r' || c == '\t':
+			b.WriteByte(' ')
+		case isControl(rune(c)):
+			return "", errors.Errorf("the streaming load sql is sent in the %s header, it can't contain the control character %q", DatabendSQLHeader, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// formatFileFormatOptions renders the options as the body of a FILE_FORMAT clause,
+// numbers and booleans are kept as they are and the other values are quoted.
+func formatFileFormatOptions(options map[string]string) string {
+	keys := make([]string, 0, len(options))
+	for k, v := range options {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	items := make([]string, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, fmt.Sprintf("%s = %s", k, formatOptionValue(options[k])))
+	}
+	return strings.Join(items, " ")
+}
+
+var optionValueReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// quoteString returns the string as a quoted sql literal.
+func quoteString(s string) string {
+	return "'" + optionValueReplacer.Replace(s) + "'"
+}
+
+func formatOptionValue(v string) string {
+	if _, err := strconv.ParseUint(v, 10, 64); err == nil {
+		return v
+	}
+	if strings.EqualFold(v, "true") || strings.EqualFold(v, "false") {
+		return v
+	}
+	return quoteString(v)
+}
+
+// StreamingLoad streams the data of the reader into the server, see
+// APIClient.StreamingLoad. It's reachable through sql.Conn.Raw:
+//
+//	err := conn.Raw(func(driverConn interface{}) error {
+//		_, err := driverConn.(*godatabend.DatabendConn).StreamingLoad(ctx, sql, r, nil)
+//		return err
+//	})
+func (dc *DatabendConn) StreamingLoad(ctx context.Context, sql string, input io.Reader, formatOptions map[string]string) (*LoadResponse, error) {
+	if dc.rest == nil {
+		return nil, driver.ErrBadConn
+	}
+	return dc.rest.StreamingLoad(dc.rest.checkQueryID(ctx), sql, input, formatOptions)
+}
@@ -0,0 +1,90 @@
+package godatabend
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamingLoad(t *testing.T) {
+	var (
+		gotSQL     string
+		gotSession string
+		gotData    string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/streaming_load" || r.Method != "PUT" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		gotSQL = r.Header.Get(DatabendSQLHeader)
+		gotSession = r.Header.Get(DatabendQueryContext)
+		file, _, err := r.FormFile("upload")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		gotData = string(data)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(gotSQL, "bad") {
+			_, _ = w.Write([]byte(`{"id":"q2","error":{"code":1046,"message":"bad data"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"q1","stats":{"rows":2,"bytes":8}}`))
+	}))
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	ctx := context.WithValue(context.Background(), ContextKeyDeduplicateLabel, "label-1")
+	resp, err := dc.StreamingLoad(ctx, "INSERT INTO t FROM @_databend_load", strings.NewReader("1,a\n2,b\n"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "q1", resp.ID)
+	assert.Equal(t, QueryProgress{Rows: 2, Bytes: 8}, resp.Stats)
+	assert.Equal(t, `INSERT INTO t FROM @_databend_load FILE_FORMAT = (field_delimiter = ',' record_delimiter = '\n' skip_header = 0 type = 'CSV')`, gotSQL)
+	assert.Contains(t, gotSession, `"deduplicate_label":"label-1"`)
+	assert.Equal(t, "1,a\n2,b\n", gotData)
+
+	_, err = dc.StreamingLoad(context.Background(), "INSERT INTO bad FROM @_databend_load", strings.NewReader("x"), map[string]string{"type": "NDJSON"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bad data")
+	assert.True(t, strings.HasSuffix(gotSQL, "FILE_FORMAT = (type = 'NDJSON')"))
+}
+
+func TestStreamingLoadMultiLineSQL(t *testing.T) {
+	var gotSQL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSQL = r.Header.Get(DatabendSQLHeader)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"q1","stats":{"rows":1,"bytes":4}}`))
+	}))
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	sql := "INSERT INTO t -- the target\r\n\tSELECT $1, 'a\tb' FROM @_databend_load"
+	_, err := dc.rest.StreamingLoad(context.Background(), sql, strings.NewReader("1,a\n"), nil)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(gotSQL, "INSERT INTO t   SELECT $1, 'a\tb' FROM @_databend_load FILE_FORMAT = ("), gotSQL)
+
+	gotSQL = ""
+	_, err = dc.rest.StreamingLoad(context.Background(), "INSERT INTO t SELECT 'a\nb' FROM @_databend_load", strings.NewReader("1,a\n"), nil)
+	assert.ErrorContains(t, err, "line breaks and control characters in the quoted strings must be escaped")
+	assert.Empty(t, gotSQL)
+}
+
+func TestFormatFileFormatOptions(t *testing.T) {
+	options := map[string]string{
+		"type":                           "CSV",
+		"field_delimiter":                "'",
+		"skip_header":                    "1",
+		"compression":                    "",
+		"error_on_column_count_mismatch": "false",
+	}
+	assert.Equal(t, `error_on_column_count_mismatch = false field_delimiter = '\'' skip_header = 1 type = 'CSV'`, formatFileFormatOptions(options))
+}
@@ -1,8 +1,10 @@
 package tests
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -11,15 +13,21 @@ func (s *DatabendTestSuite) TestChangeDatabase() {
 	r := require.New(s.T())
 	var result string
 
-	_, err := s.db.Exec("use system")
+	// the session is kept by a connection, and reset once it's back to the pool
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	r.Nil(err)
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "use system")
 	r.Nil(err)
-	err = s.db.QueryRow("select currentDatabase()").Scan(&result)
+	err = conn.QueryRowContext(ctx, "select currentDatabase()").Scan(&result)
 	r.Nil(err)
 	r.Equal("system", result)
 
-	_, err = s.db.Exec("use default")
+	_, err = conn.ExecContext(ctx, "use default")
 	r.Nil(err)
-	err = s.db.QueryRow("select currentDatabase()").Scan(&result)
+	err = conn.QueryRowContext(ctx, "select currentDatabase()").Scan(&result)
 	r.Nil(err)
 	r.Equal("default", result)
 }
@@ -67,19 +75,24 @@ func (s *DatabendTestSuite) TestSessionConfig() {
 
 	var result int64
 
-	err := s.db.QueryRow("select value from system.settings where name=?", "max_result_rows").Scan(&result)
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	r.Nil(err)
+	defer conn.Close()
+
+	err = conn.QueryRowContext(ctx, "select value from system.settings where name=?", "max_result_rows").Scan(&result)
 	r.Nil(err)
 	r.Equal(int64(0), result)
 
-	_, err = s.db.Exec("set max_result_rows = 100")
+	_, err = conn.ExecContext(ctx, "set max_result_rows = 100")
 	r.Nil(err)
-	err = s.db.QueryRow("select value from system.settings where name=?", "max_result_rows").Scan(&result)
+	err = conn.QueryRowContext(ctx, "select value from system.settings where name=?", "max_result_rows").Scan(&result)
 	r.Nil(err)
 	r.Equal(int64(100), result)
 
-	_, err = s.db.Exec("unset max_result_rows")
+	_, err = conn.ExecContext(ctx, "unset max_result_rows")
 	r.Nil(err)
-	err = s.db.QueryRow("select value from system.settings where name=?", "max_result_rows").Scan(&result)
+	err = conn.QueryRowContext(ctx, "select value from system.settings where name=?", "max_result_rows").Scan(&result)
 	r.Nil(err)
 	r.Equal(int64(0), result)
 }
@@ -89,9 +102,14 @@ func (s *DatabendTestSuite) TestSessionVariable() {
 
 	var result int64
 
-	_, err := s.db.Exec("set variable a = 100")
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	r.Nil(err)
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "set variable a = 100")
 	r.Nil(err)
-	err = s.db.QueryRow("select $a").Scan(&result)
+	err = conn.QueryRowContext(ctx, "select $a").Scan(&result)
 	r.Nil(err)
 	r.Equal(int64(100), result)
 }
@@ -1,43 +1,206 @@
 package godatabend
 
 import (
+	"context"
+	"database/sql"
 	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrTxnAborted is returned by the statements and the commit of a transaction aborted
+	// by a failed statement, such a transaction can only be rolled back.
+	ErrTxnAborted = errors.New("transaction aborted by a failed statement")
+	// ErrTxnEnded is returned by the statements and the commit of a transaction already
+	// ended on the server, such as rolled back after its statement was canceled.
+	ErrTxnEnded = errors.New("transaction already ended")
+	// ErrReadOnlyTxn is returned by the statements changing data in a read-only transaction.
+	ErrReadOnlyTxn = errors.New("not allowed in a read-only transaction")
 )
 
+// readOnlyKeywords are the leading keywords of the statements allowed in a read-only
+// transaction.
+var readOnlyKeywords = map[string]bool{
+	"SELECT": true, "WITH": true, "SHOW": true, "DESC": true, "DESCRIBE": true, "EXPLAIN": true,
+	"SET": true, "UNSET": true, "USE": true, "COMMIT": true, "ROLLBACK": true,
+}
+
+// txnRollbackTimeout limits the rollback of a transaction whose statement was canceled,
+// the context of the statement can't be used for it.
+const txnRollbackTimeout = 30 * time.Second
+
 type databendTx struct {
-	dc *DatabendConn
+	dc       *DatabendConn
+	readOnly bool
+	// spools are the spools of the batches inserted in the transaction, they are removed
+	// when the transaction ends, unless its commit may have been applied
+	spools []*spoolManifest
+}
+
+// BeginTx starts a transaction, the transactions of Databend are of snapshot isolation so
+// only the default and the snapshot isolation levels are accepted. A read-only transaction
+// refuses the statements changing data before they are sent.
+func (dc *DatabendConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if dc.rest == nil {
+		return nil, driver.ErrBadConn
+	}
+	switch level := sql.IsolationLevel(opts.Isolation); level {
+	case sql.LevelDefault, sql.LevelSnapshot:
+	default:
+		return nil, errors.Errorf("isolation level %s is not supported, only snapshot isolation is", level)
+	}
+	if dc.rest.inActiveTransaction() {
+		return nil, errors.New("already in a transaction")
+	}
+	if _, err := dc.exec(ctx, "BEGIN"); err != nil {
+		return nil, err
+	}
+	if state := dc.rest.txnState(); state != TxnStateActive {
+		return nil, errors.Errorf("transaction not started, the server reports txn_state %q", state)
+	}
+	dc.tx = &databendTx{dc: dc, readOnly: opts.ReadOnly}
+	return dc.tx, nil
 }
 
 func (tx *databendTx) Commit() (err error) {
-	if tx.dc == nil || tx.dc.rest == nil {
+	dc := tx.dc
+	if dc == nil || dc.rest == nil {
 		return driver.ErrBadConn
 	}
-	defer func() {
-		tx.dc.batchInsert = nil
-	}()
-	if tx.dc.batchMode && tx.dc.batchInsert != nil {
-		err = tx.dc.batchInsert()
-		if err != nil {
-			return
+	defer tx.end()
+	if dc.batchMode && dc.batchInsert != nil {
+		if err = dc.batchInsert(); err != nil {
+			tx.rollbackIfOpen(dc.ctx)
+			return err
 		}
 	}
-	// compatible with old server version
-	if tx.dc.rest.sessionState.TxnState != "" {
-		_, err = tx.dc.exec(tx.dc.ctx, "COMMIT")
-		if err != nil {
-			return
+	switch dc.rest.txnState() {
+	case TxnStateActive:
+		if _, err = dc.exec(dc.ctx, "COMMIT"); err != nil {
+			tx.rollbackIfOpen(dc.ctx)
+			if mayBeApplied(dc.ctx, err) {
+				// the transaction may be committed, the spooled batches are inserted
+				// again under their labels by RecoverSpool
+				for _, spool := range tx.spools {
+					spool.release()
+				}
+				tx.spools = nil
+			}
+			return err
 		}
+		return nil
+	case TxnStateFail:
+		tx.rollbackIfOpen(dc.ctx)
+		return ErrTxnAborted
+	default:
+		return ErrTxnEnded
 	}
-	return
 }
 
-func (tx *databendTx) Rollback() (err error) {
-	if tx.dc == nil || tx.dc.rest == nil {
+// Rollback rolls back the transaction, it's a no-op if the transaction has been ended on
+// the server, such as rolled back after its statement was canceled.
+func (tx *databendTx) Rollback() error {
+	dc := tx.dc
+	if dc == nil || dc.rest == nil {
 		return driver.ErrBadConn
 	}
-	_, err = tx.dc.exec(tx.dc.ctx, "ROLLBACK")
-	if err != nil {
+	defer tx.end()
+	if !dc.rest.inActiveTransaction() {
+		return nil
+	}
+	_, err := dc.exec(dc.ctx, "ROLLBACK")
+	return err
+}
+
+func (tx *databendTx) end() {
+	for _, spool := range tx.spools {
+		if err := spool.remove(); err != nil {
+			tx.dc.log("delete batch spool dir failed: ", err)
+		}
+	}
+	tx.spools = nil
+	tx.dc.tx = nil
+	tx.dc.discardBatch()
+}
+
+// rollbackIfOpen rolls back the transaction still open on the server, the connection is
+// marked broken if it fails, so it's not reused in the transaction.
+func (tx *databendTx) rollbackIfOpen(ctx context.Context) {
+	if !tx.dc.rest.inActiveTransaction() {
+		return
+	}
+	if _, err := tx.dc.exec(ctx, "ROLLBACK"); err != nil {
+		tx.dc.rest.broken = true
+	}
+}
+
+// checkTxStatements returns the error of the statements not allowed in the transaction of
+// the connection, they are not sent to the server then.
+func (dc *DatabendConn) checkTxStatements(statements ...string) error {
+	tx := dc.tx
+	if tx == nil {
+		return nil
+	}
+	for _, statement := range statements {
+		keyword := statementKeyword(statement)
+		if keyword == "COMMIT" || keyword == "ROLLBACK" {
+			continue
+		}
+		switch dc.rest.txnState() {
+		case TxnStateActive:
+		case TxnStateFail:
+			return ErrTxnAborted
+		default:
+			return ErrTxnEnded
+		}
+		if tx.readOnly && !readOnlyKeywords[keyword] {
+			return errors.Wrapf(ErrReadOnlyTxn, "%s statement", keyword)
+		}
+	}
+	return nil
+}
+
+// rollbackOnCancel rolls back the transaction whose statement was abandoned by the
+// context, the statement may be applied partially so the transaction can't go on.
+func (dc *DatabendConn) rollbackOnCancel(ctx context.Context, err error) {
+	if dc.tx == nil || err == nil || !isContextError(ctx, err) {
 		return
 	}
-	return
+	rctx, cancel := context.WithTimeout(context.Background(), txnRollbackTimeout)
+	defer cancel()
+	dc.tx.rollbackIfOpen(rctx)
+}
+
+// statementKeyword returns the first keyword of the statement in upper case, the leading
+// comments and parentheses are skipped.
+func statementKeyword(statement string) string {
+	s := statement
+	for {
+		s = strings.TrimLeft(s, " \t\r\n(")
+		switch {
+		case strings.HasPrefix(s, "--"):
+			if end := strings.IndexByte(s, '\n'); end >= 0 {
+				s = s[end+1:]
+			} else {
+				s = ""
+			}
+		case strings.HasPrefix(s, "/*"):
+			if end := strings.Index(s, "*/"); end >= 0 {
+				s = s[end+2:]
+			} else {
+				s = ""
+			}
+		default:
+			end := strings.IndexFunc(s, func(r rune) bool {
+				return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_')
+			})
+			if end >= 0 {
+				s = s[:end]
+			}
+			return strings.ToUpper(s)
+		}
+	}
 }
@@ -0,0 +1,130 @@
+package godatabend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// txServer echoes the session, the statements on the table missing fail and abort the
+// transaction, and the slow ones keep running until they are killed.
+func txServer(t *testing.T) *testServer {
+	srv := newTestServer(t)
+	srv.onQuery = func(req QueryRequest) string {
+		switch {
+		case strings.Contains(req.SQL, "missing"):
+			session := map[string]interface{}{}
+			_ = json.Unmarshal(*req.Session, &session)
+			session["txn_state"] = TxnStateFail
+			buf, _ := json.Marshal(map[string]interface{}{"id": "q1", "state": "Failed", "session": session,
+				"error": map[string]interface{}{"code": 1025, "message": "Unknown table missing"}})
+			return string(buf)
+		case strings.Contains(req.SQL, "slow"):
+			return runningQuery
+		}
+		return echoSession(req)
+	}
+	srv.onPage = blockPages
+	return srv
+}
+
+func (s *testServer) sentSQL() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var statements []string
+	for _, req := range s.queries {
+		statements = append(statements, req.SQL)
+	}
+	return statements
+}
+
+func TestBeginTxOptions(t *testing.T) {
+	srv := txServer(t)
+	defer srv.Close()
+	db := openTestDB(t, srv.URL)
+	ctx := context.Background()
+
+	_, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	assert.ErrorContains(t, err, "isolation level Serializable is not supported")
+	assert.Empty(t, srv.sentSQL())
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSnapshot, ReadOnly: true})
+	require.NoError(t, err)
+	_, err = tx.Exec("SELECT 1")
+	require.NoError(t, err)
+	_, err = tx.Exec("/* load */ INSERT INTO t VALUES (1)")
+	assert.True(t, errors.Is(err, ErrReadOnlyTxn))
+	assert.ErrorContains(t, err, "INSERT statement")
+	require.NoError(t, tx.Commit())
+	assert.Equal(t, []string{"BEGIN", "SELECT 1", "COMMIT"}, srv.sentSQL())
+}
+
+func TestBeginTxNotStarted(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	db := openTestDB(t, srv.URL)
+
+	// the server reports no txn_state
+	_, err := db.Begin()
+	assert.ErrorContains(t, err, "transaction not started")
+}
+
+func TestTxAbortedByFailedStatement(t *testing.T) {
+	srv := txServer(t)
+	defer srv.Close()
+	db := openTestDB(t, srv.URL)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec("INSERT INTO missing VALUES (1)")
+	assert.ErrorContains(t, err, "Unknown table missing")
+	_, err = tx.Exec("INSERT INTO t VALUES (2)")
+	assert.Equal(t, ErrTxnAborted, err)
+	assert.Equal(t, ErrTxnAborted, tx.Commit())
+	assert.Equal(t, []string{"BEGIN", "INSERT INTO missing VALUES (1)", "ROLLBACK"}, srv.sentSQL())
+
+	// the connection is clean for the next transaction
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+}
+
+func TestTxRolledBackOnCancel(t *testing.T) {
+	srv := txServer(t)
+	defer srv.Close()
+	db := openTestDB(t, srv.URL)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = tx.ExecContext(ctx, "INSERT INTO t SELECT * FROM slow")
+	require.Error(t, err)
+	assert.Contains(t, srv.requestedPages(), "/v1/query/q1/kill")
+	assert.Equal(t, []string{"BEGIN", "INSERT INTO t SELECT * FROM slow", "ROLLBACK"}, srv.sentSQL())
+
+	_, err = tx.Exec("INSERT INTO t VALUES (1)")
+	assert.Equal(t, ErrTxnEnded, err)
+	assert.Equal(t, ErrTxnEnded, tx.Commit())
+	assert.Len(t, srv.sentSQL(), 3)
+}
+
+func TestStatementKeyword(t *testing.T) {
+	tests := map[string]string{
+		"select 1":                      "SELECT",
+		"  -- note\n/* x */ (SELECT 1)": "SELECT",
+		"INSERT INTO t VALUES (1)":      "INSERT",
+		"with t AS (SELECT 1) SELECT":   "WITH",
+		"-- only a comment":             "",
+	}
+	for statement, keyword := range tests {
+		assert.Equal(t, keyword, statementKeyword(statement), statement)
+	}
+}
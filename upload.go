@@ -0,0 +1,424 @@
+package godatabend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avast/retry-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultUploadTimeout = 60 * time.Second
+	uploadChunkScanSize  = 64 * 1024
+)
+
+// UploadProgress describes the progress of UploadFileToStage.
+type UploadProgress struct {
+	Chunks         int
+	ChunksUploaded int
+	Bytes          int64
+	BytesUploaded  int64
+}
+
+// UploadProgressTracker is called once a chunk of UploadFileToStage has been uploaded,
+// the calls of one upload are never concurrent.
+type UploadProgressTracker func(progress UploadProgress)
+
+// UploadOptions tunes UploadFileToStage, a nil UploadOptions uploads the file as a whole.
+type UploadOptions struct {
+	// ChunkSize splits the file into chunks of about the size, which are cut at line
+	// boundaries and uploaded as the files part-00001, part-00002... under the stage path,
+	// even if the file is smaller than a chunk. So the stage path is a directory to be
+	// loaded as a whole, not a file. It only applies to the uncompressed line based files
+	// named .csv, .tsv, .ndjson or .jsonl, the line breaks within the double quoted fields
+	// of CSV are kept within a chunk, which takes a scan of the whole file.
+	ChunkSize int64
+	// Workers is the number of chunks uploaded concurrently, default is 1.
+	Workers int
+	// Resume skips the chunks which have been uploaded with the same size and md5, it's
+	// used to continue an upload failed partially by uploading the same file to the same
+	// stage. The chunks are uploaded again if the storage doesn't list the md5 of files.
+	Resume bool
+	// VerifyChecksum compares the size and the md5 of the uploaded files with the stage
+	// listing, the md5 is only compared if the storage lists it.
+	VerifyChecksum bool
+	Progress       UploadProgressTracker
+}
+
+// lineFormats are the extensions of the files which could be split at line boundaries.
+var lineFormats = map[string]bool{".csv": true, ".tsv": true, ".ndjson": true, ".jsonl": true}
+
+type uploadChunk struct {
+	stage  *StageLocation
+	offset int64
+	size   int64
+	md5    string
+}
+
+func (c *APIClient) uploadHTTPClient() *http.Client {
+	timeout := c.UploadTimeout
+	if timeout <= 0 {
+		timeout = defaultUploadTimeout
+	}
+	cli := &http.Client{Timeout: timeout}
+	if c.cli != nil {
+		cli.Transport = c.cli.Transport
+	}
+	return cli
+}
+
+// uploadWithRetry uploads the data returned by open to the stage, by the presigned url if
+// it's not nil. The data is opened again for each attempt.
+func (c *APIClient) uploadWithRetry(ctx context.Context, stage *StageLocation, presigned *PresignedResponse, open func() (io.Reader, int64, error)) error {
+	return c.doRetry(func() error {
+		input, size, err := open()
+		if err != nil {
+			return retry.Unrecoverable(err)
+		}
+		if presigned != nil {
+			err = c.uploadToPresignedURL(ctx, presigned, bufio.NewReader(input), size)
+		} else {
+			err = c.UploadToStageByAPI(ctx, stage, bufio.NewReader(input))
+		}
+		if err != nil && ctx.Err() != nil {
+			return retry.Unrecoverable(ctx.Err())
+		}
+		return err
+	}, Upload)
+}
+
+// uploadPool runs the uploads to a stage by a limited number of workers, it keeps the
+// first error of the uploads.
+type uploadPool struct {
+	client  *APIClient
+	workers chan struct{}
+	wg      sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func newUploadPool(client *APIClient, workers int) *uploadPool {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &uploadPool{client: client, workers: make(chan struct{}, workers)}
+}
+
+// upload hands the upload of the stage file over to a worker, it blocks while all the
+// workers are busy. The presign query goes through the client session, so it's done
+// before the upload is dispatched, and its error is returned without running the upload.
+func (p *uploadPool) upload(ctx context.Context, stage *StageLocation, upload func(presigned *PresignedResponse) error) error {
+	var presigned *PresignedResponse
+	if !p.client.PresignedURLDisabled {
+		var err error
+		presigned, err = p.client.GetPresignedURL(ctx, stage)
+		if err != nil {
+			return errors.Wrap(err, "failed to get presigned url")
+		}
+	}
+	p.workers <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.workers
+			p.wg.Done()
+		}()
+		if err := upload(presigned); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// uploadErr returns the first error of the finished uploads.
+func (p *uploadPool) uploadErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// wait waits for the running uploads and returns the first error of them.
+func (p *uploadPool) wait() error {
+	p.wg.Wait()
+	return p.uploadErr()
+}
+
+// UploadFileToStage uploads the local file to the stage, the failed requests are retried
+// up to Config.UploadRetries times. A large file could be split into chunks uploaded
+// concurrently, and resumed after a partial failure, see UploadOptions.
+func (c *APIClient) UploadFileToStage(ctx context.Context, stage *StageLocation, filePath string, opts *UploadOptions) error {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var chunks []*uploadChunk
+	if opts.ChunkSize > 0 {
+		ext := strings.ToLower(filepath.Ext(filePath))
+		if !lineFormats[ext] {
+			return errors.Errorf("can't split %s into chunks, only the uncompressed csv, tsv and ndjson files can be", filePath)
+		}
+		dir := stage.Path
+		if !strings.HasSuffix(dir, "/") {
+			dir += "/"
+		}
+		offsets, err := splitLines(f, fi.Size(), opts.ChunkSize, ext == ".csv")
+		if err != nil {
+			return errors.Wrap(err, "split file into chunks failed")
+		}
+		for i, offset := range offsets {
+			end := fi.Size()
+			if i+1 < len(offsets) {
+				end = offsets[i+1]
+			}
+			chunks = append(chunks, &uploadChunk{
+				stage:  &StageLocation{Name: stage.Name, Path: fmt.Sprintf("%spart-%05d%s", dir, i+1, ext)},
+				offset: offset,
+				size:   end - offset,
+			})
+		}
+	} else {
+		chunks = []*uploadChunk{{stage: stage, size: fi.Size()}}
+	}
+
+	u := &chunkedUpload{
+		client:   c,
+		ctx:      ctx,
+		file:     f,
+		opts:     opts,
+		progress: UploadProgress{Chunks: len(chunks), Bytes: fi.Size()},
+	}
+	if opts.Resume {
+		if chunks, err = u.skipUploaded(chunks); err != nil {
+			return err
+		}
+	}
+	if err = u.run(chunks); err != nil {
+		return err
+	}
+	if opts.VerifyChecksum {
+		return u.verify(chunks)
+	}
+	return nil
+}
+
+// splitLines returns the offsets of the chunks of about the size, each chunk but the
+// last one ends with a line break. The line breaks within the double quoted fields are
+// skipped if quoted is set, the file is scanned from the start for the quotes then.
+func splitLines(r io.ReaderAt, fileSize, chunkSize int64, quoted bool) ([]int64, error) {
+	if quoted {
+		return splitQuotedLines(r, fileSize, chunkSize)
+	}
+	offsets := []int64{0}
+	buf := make([]byte, uploadChunkScanSize)
+	for next := chunkSize; next < fileSize; {
+		n, err := r.ReadAt(buf, next-1)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			next += int64(i)
+			if next >= fileSize {
+				break
+			}
+			offsets = append(offsets, next)
+			next += chunkSize
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		next += int64(n)
+	}
+	return offsets, nil
+}
+
+func splitQuotedLines(r io.ReaderAt, fileSize, chunkSize int64) ([]int64, error) {
+	offsets := []int64{0}
+	br := bufio.NewReaderSize(io.NewSectionReader(r, 0, fileSize), uploadChunkScanSize)
+	// an escaped quote "" toggles the state twice
+	inQuotes := false
+	next := chunkSize
+	for pos := int64(1); pos < fileSize; pos++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '\n' && !inQuotes && pos >= next:
+			offsets = append(offsets, pos)
+			next = pos + chunkSize
+		}
+	}
+	return offsets, nil
+}
+
+type chunkedUpload struct {
+	client *APIClient
+	ctx    context.Context
+	file   *os.File
+	opts   *UploadOptions
+
+	mu       sync.Mutex
+	progress UploadProgress
+	// serializes the progress tracker calls
+	trackMu sync.Mutex
+}
+
+func (u *chunkedUpload) skipUploaded(chunks []*uploadChunk) ([]*uploadChunk, error) {
+	uploaded, err := u.listUploaded(chunks)
+	if err != nil {
+		return nil, err
+	}
+	var pending []*uploadChunk
+	for _, chunk := range chunks {
+		if file, ok := uploaded[chunk.stage.Path]; ok {
+			same, err := u.sameContent(chunk, file)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				u.progress.ChunksUploaded++
+				u.progress.BytesUploaded += chunk.size
+				continue
+			}
+		}
+		pending = append(pending, chunk)
+	}
+	return pending, nil
+}
+
+// sameContent reports whether the stage file has the size and the md5 of the chunk, it's
+// false if the storage doesn't list the md5.
+func (u *chunkedUpload) sameContent(chunk *uploadChunk, file StageFile) (bool, error) {
+	if file.Size != chunk.size || file.MD5 == "" {
+		return false, nil
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, io.NewSectionReader(u.file, chunk.offset, chunk.size)); err != nil {
+		return false, errors.Wrap(err, "read file failed")
+	}
+	chunk.md5 = hex.EncodeToString(h.Sum(nil))
+	return strings.EqualFold(file.MD5, chunk.md5), nil
+}
+
+// listUploaded returns the stage files of the chunks by their paths.
+func (u *chunkedUpload) listUploaded(chunks []*uploadChunk) (map[string]StageFile, error) {
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	dir := &StageLocation{Name: chunks[0].stage.Name, Path: chunks[0].stage.Path}
+	if len(chunks) > 1 {
+		dir.Path = path.Dir(dir.Path) + "/"
+	}
+	files, err := u.client.ListStage(u.client.checkQueryID(u.ctx), dir, "")
+	if err != nil {
+		return nil, err
+	}
+	uploaded := make(map[string]StageFile, len(files))
+	for _, file := range files {
+		uploaded[strings.TrimPrefix(file.Name, "/")] = file
+	}
+	return uploaded, nil
+}
+
+func (u *chunkedUpload) run(chunks []*uploadChunk) error {
+	pool := newUploadPool(u.client, u.opts.Workers)
+	for _, chunk := range chunks {
+		if pool.uploadErr() != nil {
+			break
+		}
+		chunk := chunk
+		err := pool.upload(u.client.checkQueryID(u.ctx), chunk.stage, func(presigned *PresignedResponse) error {
+			if err := u.upload(chunk, presigned); err != nil {
+				return errors.Wrapf(err, "upload %s failed", chunk.stage)
+			}
+			u.mu.Lock()
+			u.progress.ChunksUploaded++
+			u.progress.BytesUploaded += chunk.size
+			u.mu.Unlock()
+			u.trackProgress()
+			return nil
+		})
+		if err != nil {
+			_ = pool.wait()
+			return err
+		}
+	}
+	return pool.wait()
+}
+
+func (u *chunkedUpload) upload(chunk *uploadChunk, presigned *PresignedResponse) error {
+	var h hash.Hash
+	ctx := u.client.checkQueryID(u.ctx)
+	err := u.client.uploadWithRetry(ctx, chunk.stage, presigned, func() (io.Reader, int64, error) {
+		h = md5.New()
+		return io.TeeReader(io.NewSectionReader(u.file, chunk.offset, chunk.size), h), chunk.size, nil
+	})
+	if err != nil {
+		return err
+	}
+	chunk.md5 = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+func (u *chunkedUpload) verify(chunks []*uploadChunk) error {
+	uploaded, err := u.listUploaded(chunks)
+	if err != nil {
+		return errors.Wrap(err, "list uploaded files failed")
+	}
+	for _, chunk := range chunks {
+		file, ok := uploaded[chunk.stage.Path]
+		if !ok {
+			return errors.Errorf("uploaded file %s is not found", chunk.stage)
+		}
+		if file.Size != chunk.size {
+			return errors.Errorf("uploaded file %s has %d bytes, expect %d", chunk.stage, file.Size, chunk.size)
+		}
+		if file.MD5 != "" && chunk.md5 != "" && !strings.EqualFold(file.MD5, chunk.md5) {
+			return errors.Errorf("uploaded file %s has md5 %s, expect %s", chunk.stage, file.MD5, chunk.md5)
+		}
+	}
+	return nil
+}
+
+func (u *chunkedUpload) trackProgress() {
+	if u.opts.Progress == nil {
+		return
+	}
+	u.trackMu.Lock()
+	defer u.trackMu.Unlock()
+	u.mu.Lock()
+	progress := u.progress
+	u.mu.Unlock()
+	u.opts.Progress(progress)
+}
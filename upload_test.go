@@ -0,0 +1,197 @@
+package godatabend
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitLines(t *testing.T) {
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, strings.Repeat("x", i%7)+fmt.Sprint(i))
+	}
+	content := strings.Join(lines, "\n") + "\n"
+	for _, quoted := range []bool{false, true} {
+		offsets, err := splitLines(strings.NewReader(content), int64(len(content)), 50, quoted)
+		require.NoError(t, err)
+		require.True(t, len(offsets) > 1)
+		assert.Equal(t, int64(0), offsets[0])
+		for i, offset := range offsets[1:] {
+			assert.Equal(t, byte('\n'), content[offset-1])
+			assert.True(t, offset-offsets[i] >= 50)
+		}
+
+		offsets, err = splitLines(strings.NewReader("no line break at all"), 20, 5, quoted)
+		require.NoError(t, err)
+		assert.Equal(t, []int64{0}, offsets)
+	}
+
+	// the line breaks of the quoted fields are not chunk boundaries
+	csv := "1,\"a\nb\"\"\nc\"\n2,x\n3,\"\n\n\"\n"
+	offsets, err := splitLines(strings.NewReader(csv), int64(len(csv)), 1, true)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{0, 12, 16}, offsets)
+}
+
+// listUploads responds the LIST queries by the files uploaded to the test server.
+func (s *testServer) listUploads(req QueryRequest) string {
+	if !strings.HasPrefix(req.SQL, "LIST ") {
+		return `{"id":"q1","state":"Succeeded"}`
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var data [][]string
+	for name, content := range s.uploads {
+		sum := md5.Sum(content)
+		data = append(data, []string{name, fmt.Sprint(len(content)), hex.EncodeToString(sum[:]), "2024-01-02 03:04:05.000 +0000"})
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i][0] < data[j][0] })
+	buf, _ := json.Marshal(data)
+	return fmt.Sprintf(`{"id":"q1","state":"Succeeded","data":%s}`, buf)
+}
+
+func TestUploadFileToStageChunked(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.onQuery = srv.listUploads
+
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf("%d,name-%d", i, i))
+	}
+	content := strings.Join(lines, "\n") + "\n"
+	path := filepath.Join(t.TempDir(), "data.csv")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+	dc := newTestConn(t, srv.URL)
+	var progress []UploadProgress
+	opts := &UploadOptions{
+		ChunkSize:      100,
+		Workers:        3,
+		VerifyChecksum: true,
+		Progress: func(p UploadProgress) {
+			progress = append(progress, p)
+		},
+	}
+	stage := &StageLocation{Name: "~", Path: "upload/data"}
+	require.NoError(t, dc.rest.UploadFileToStage(context.Background(), stage, path, opts))
+
+	chunks := len(srv.uploads)
+	require.True(t, chunks > 1)
+	var uploaded string
+	for i := 1; i <= chunks; i++ {
+		data, ok := srv.uploads[fmt.Sprintf("upload/data/part-%05d.csv", i)]
+		require.True(t, ok)
+		uploaded += string(data)
+	}
+	assert.Equal(t, content, uploaded)
+	require.Len(t, progress, chunks)
+	assert.Equal(t, UploadProgress{Chunks: chunks, ChunksUploaded: chunks, Bytes: int64(len(content)), BytesUploaded: int64(len(content))}, progress[chunks-1])
+
+	// lose the last chunk and corrupt the first one, only they are uploaded again on resume
+	last := fmt.Sprintf("upload/data/part-%05d.csv", chunks)
+	first := "upload/data/part-00001.csv"
+	srv.mu.Lock()
+	srv.uploads[last] = []byte("partial")
+	firstContent := srv.uploads[first]
+	srv.uploads[first] = []byte(strings.Repeat("x", len(firstContent)))
+	srv.mu.Unlock()
+	progress = nil
+	opts.Resume = true
+	require.NoError(t, dc.rest.UploadFileToStage(context.Background(), stage, path, opts))
+	require.Len(t, progress, 2)
+	assert.Equal(t, chunks, progress[1].ChunksUploaded)
+	assert.True(t, strings.HasSuffix(content, string(srv.uploads[last])))
+	assert.Equal(t, firstContent, srv.uploads[first])
+
+	// without the md5 in the listing, the uploaded chunks can't be told apart
+	srv.onQuery = func(req QueryRequest) string {
+		return regexp.MustCompile(`"[0-9a-f]{32}"`).ReplaceAllString(srv.listUploads(req), `""`)
+	}
+	progress = nil
+	require.NoError(t, dc.rest.UploadFileToStage(context.Background(), stage, path, opts))
+	assert.Len(t, progress, chunks)
+
+	// a file changed on the stage is found by the listing
+	srv.onQuery = func(req QueryRequest) string {
+		return strings.Replace(srv.listUploads(req), `"`+last+`","`, `"`+last+`","1`, 1)
+	}
+	opts.Resume = false
+	err := dc.rest.UploadFileToStage(context.Background(), stage, path, opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), last)
+}
+
+func TestUploadFileToStageChunkedFormats(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	dir := t.TempDir()
+	opts := &UploadOptions{ChunkSize: 100}
+	for _, name := range []string{"data.parquet", "data.csv.gz", "data"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte("1,a\n2,b\n"), 0644))
+		err := dc.rest.UploadFileToStage(context.Background(), &StageLocation{Name: "~", Path: "upload/" + name}, path, opts)
+		assert.Error(t, err, name)
+	}
+	assert.Empty(t, srv.uploads)
+
+	// a file smaller than a chunk is still uploaded into the directory
+	path := filepath.Join(dir, "data.ndjson")
+	require.NoError(t, os.WriteFile(path, []byte("{}\n"), 0644))
+	require.NoError(t, dc.rest.UploadFileToStage(context.Background(), &StageLocation{Name: "~", Path: "upload/small"}, path, opts))
+	assert.Equal(t, "{}\n", string(srv.uploads["upload/small/part-00001.ndjson"]))
+}
+
+func TestUploadRetry(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.failUploads = 1
+
+	path := filepath.Join(t.TempDir(), "data.csv")
+	require.NoError(t, os.WriteFile(path, []byte("1,a\n"), 0644))
+
+	dc := newTestConn(t, srv.URL)
+	stage := &StageLocation{Name: "~", Path: "upload/data.csv"}
+	require.NoError(t, dc.rest.UploadFileToStage(context.Background(), stage, path, nil))
+	assert.Equal(t, "1,a\n", string(srv.uploads["upload/data.csv"]))
+
+	srv.failUploads = 1
+	dc.rest.UploadRetries = 1
+	err := dc.rest.UploadFileToStage(context.Background(), stage, path, nil)
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "503"), err.Error())
+}
+
+func TestUploadCanceled(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	dc := newTestConn(t, srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stage := &StageLocation{Name: "~", Path: "upload/data.csv"}
+	err := dc.rest.UploadToStageByAPI(ctx, stage, bufio.NewReader(strings.NewReader("1,a\n")))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), context.Canceled.Error())
+
+	err = dc.rest.uploadToPresignedURL(ctx, &PresignedResponse{URL: srv.URL + "/presigned"},
+		bufio.NewReader(strings.NewReader("1,a\n")), 4)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), context.Canceled.Error())
+	assert.Empty(t, srv.uploads)
+}